@@ -1,84 +1,84 @@
 package micromon
 
 import (
+	"context"
 	"log"
-	"time"
+	"testing"
 )
 
 //Start... starts MicroMon with the configuration file which path is given in parameter.
-func Start(path string) {
-	//Get configuration from file
-	conf := GetConfig(path)
-
-	//Get channel for receiving website response data
-	ch := WatchWebsites(conf)
-
-	//Create data structure for holding response data
-	datas := NewRespMap(len(conf.Websites))
-	for k, _ := range conf.Websites {
-		datas[k] = NewSafeData()
+//It blocks until an error occurs. See Monitor to control MicroMon lifecycle.
+func Start(path string) error {
+	conf, err := FetchConfig(path)
+	if err != nil {
+		return err
 	}
-
-	//Configure metrics, hook and reporter
-	metrics := GetMetrics(conf)
-	reporter := GetReporter(conf)
-	hooks := GetHooks(conf)
-
-	//Compute and write metrics every 10 seconds
-	go func() {
-		i := 0
-		for range time.Tick(10 * time.Second) {
-			i++
-			res := make([][]WebMetrics, 0)
-			//Metrics for the last 2 minutes and the last 10 minutes
-			res = append(res, (&datas).ComputeMetrics(metrics, 2))
-
-			//We apply hooks only once (avoiding repeating logging)... TODO May be improved!
-			applyHooks(res, hooks)
-			res = append(res, (&datas).ComputeMetrics(metrics, 10))
-
-			//Metrics for the last hour are reported every minute
-			if i%6 == 0 {
-				res = append(res, (&datas).ComputeMetrics(metrics, 60))
-			}
-
-			reportResults(res, reporter)
-		}
-	}()
-
-	//Forever listen to data coming from channel : sequential access to datas variable
-	for {
-		data := <-ch
-		name := data.Name
-		datas[name].Mux.Lock()
-		datas[name].Datas = append(datas[name].Datas, data)
-		datas[name].Mux.Unlock()
+	m, err := NewMonitor(conf)
+	if err != nil {
+		return err
 	}
+	return m.Run(context.Background())
+}
+
+//tests lists the tests performed by LaunchTests, in order, with the name they are reported with.
+var tests = []struct {
+	name string
+	test func() bool
+}{
+	{"Alerting", TestAlerting},
+	{"File storage", TestFileStore},
+	{"Durations", TestDurations},
+	{"Rollups", TestRollups},
+	{"Sketch", TestSketch},
+	{"Histograms", TestHistogram},
+	{"Certificates", TestCertificates},
+	{"Timings", TestTimings},
+	{"Reload", TestReload},
+	{"Probers", TestProbers},
+	{"Requests", TestRequests},
+	{"Assertions", TestAssertions},
+	{"Ring", TestRing},
+	{"Windows", TestWindows},
+	{"Timeframes", TestTimeframes},
+	{"Stop", TestStop},
+	{"Overrides", TestOverrides},
+	{"Config errors", TestConfigErrors},
+	{"Groups", TestGroups},
+	{"Labels", TestLabels},
+	{"Rules", TestRules},
+	{"Notifiers", TestNotifiers},
+	{"Hysteresis", TestHysteresis},
+	{"Incidents", TestIncidents},
+	{"Maintenance", TestMaintenance},
+	{"Heartbeats", TestHeartbeats},
+	{"Transactions", TestTransactions},
 }
 
 //launchTests performs tests against the application logic and report results.
+//It stops at the first test which fails.
 func LaunchTests() {
 	log.Printf("Starting tests...")
-	if TestAlerting() {
-		log.Print("Alerting test successfully passed !")
-	} else {
-		log.Fatalf("Alert test failed !")
+	for _, t := range tests {
+		if !t.test() {
+			log.Fatalf("%s test failed !", t.name)
+		}
+		log.Printf("%s test successfully passed !", t.name)
 	}
 	log.Printf("All tests passed !")
 }
 
-//reportResult takes a slice of []WebMetrics and report information for each inner slice.
-func reportResults(metrics [][]WebMetrics, reporter Reporter) {
-	for _, v := range metrics {
-		reporter.Report(v)
-	}
+//LaunchBenchmarks runs benchmarks against storage and computation logic and report results.
+func LaunchBenchmarks() {
+	log.Printf("Starting benchmarks...")
+	reportBenchmark("Window lookup (ring buffer)", BenchmarkWindow)
+	reportBenchmark("Window lookup (linear scan)", BenchmarkLinearWindow)
+	reportBenchmark("Sample insertion", BenchmarkAdd)
+	reportBenchmark("Metrics computation", BenchmarkComputeMetrics)
+	log.Printf("All benchmarks done !")
 }
 
-//applyHook takes a slice of []WebMetrics and call hooks for each inner slice.
-func applyHooks(metrics [][]WebMetrics, hooks []Hook) {
-	for _, v := range metrics {
-		for _, h := range hooks {
-			h(v)
-		}
-	}
+//reportBenchmark runs a benchmark function and logs its result.
+func reportBenchmark(name string, b func(*testing.B)) {
+	res := testing.Benchmark(b)
+	log.Printf("%v :\t%v\t%v", name, res, res.MemString())
 }
@@ -0,0 +1,234 @@
+package micromon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Assertions describes what a response must look like for a website to be considered available.
+//Status accepts codes ("200"), classes ("2xx") and ranges ("200-299"). Body rules are substrings and regular expressions
+//which must be present or absent. JSON associates simple JSON paths (e.g. "$.status" or "$.items[0].id") with expected values.
+//Headers associates header names with expected values, an empty value only requiring the header to be present.
+//MaxBodySize is expressed in bytes and MaxResponseTime in milliseconds. Zero values mean no limit.
+//Regular expressions are compiled once by compile, when a website starts being watched.
+type Assertions struct {
+	Status          []string
+	BodyContains    []string
+	BodyNotContains []string
+	BodyMatches     []string
+	BodyNotMatches  []string
+	JSON            map[string]string
+	Headers         map[string]string
+	MaxBodySize     int64
+	MaxResponseTime MillisecondDuration
+	compiled        bool
+	bodyMatches     []*regexp.Regexp
+	bodyNotMatches  []*regexp.Regexp
+}
+
+//validate checks that status rules, regular expressions and JSON paths are well-formed.
+func (a Assertions) validate() error {
+	for _, s := range a.Status {
+		if _, _, err := parseStatusRule(s); err != nil {
+			return err
+		}
+	}
+	if _, err := a.compile(); err != nil {
+		return err
+	}
+	for p := range a.JSON {
+		if _, err := parseJSONPath(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//compile returns the Assertions with their regular expressions compiled, so that checks do not compile them again.
+func (a Assertions) compile() (Assertions, error) {
+	a.bodyMatches, a.bodyNotMatches = make([]*regexp.Regexp, len(a.BodyMatches)), make([]*regexp.Regexp, len(a.BodyNotMatches))
+	for i, r := range a.BodyMatches {
+		re, err := regexp.Compile(r)
+		if err != nil {
+			return a, err
+		}
+		a.bodyMatches[i] = re
+	}
+	for i, r := range a.BodyNotMatches {
+		re, err := regexp.Compile(r)
+		if err != nil {
+			return a, err
+		}
+		a.bodyNotMatches[i] = re
+	}
+	a.compiled = true
+	return a, nil
+}
+
+//needsBody tells whether the response body must be read to evaluate assertions.
+func (a Assertions) needsBody() bool {
+	return len(a.BodyContains)+len(a.BodyNotContains)+len(a.BodyMatches)+len(a.BodyNotMatches)+len(a.JSON) > 0 || a.MaxBodySize > 0
+}
+
+//check evaluates assertions against a response, its body (if read) and its MetaResponse.
+//It returns a description of each failed assertion.
+func (a Assertions) check(resp *http.Response, body []byte, meta MetaResponse) []string {
+	failed := make([]string, 0)
+
+	if len(a.Status) > 0 && !matchStatus(a.Status, resp.StatusCode) {
+		failed = append(failed, fmt.Sprintf("status %d is not %s", resp.StatusCode, strings.Join(a.Status, ", ")))
+	}
+	for name, expected := range a.Headers {
+		value, ok := resp.Header[http.CanonicalHeaderKey(name)]
+		if !ok {
+			failed = append(failed, fmt.Sprintf("header %s is missing", name))
+		} else if expected != "" && value[0] != expected {
+			failed = append(failed, fmt.Sprintf("header %s is %q, expected %q", name, value[0], expected))
+		}
+	}
+	if a.MaxResponseTime > 0 && meta.RespDuration > time.Duration(a.MaxResponseTime) {
+		failed = append(failed, fmt.Sprintf("response time %vms exceeds %vms", meta.RespDuration.Nanoseconds()/int64(time.Millisecond), time.Duration(a.MaxResponseTime).Nanoseconds()/int64(time.Millisecond)))
+	}
+	//Body has been truncated, do not evaluate its content
+	if a.MaxBodySize > 0 && int64(len(body)) > a.MaxBodySize {
+		return append(failed, fmt.Sprintf("body size exceeds %v bytes", a.MaxBodySize))
+	}
+
+	//Body content
+	for _, s := range a.BodyContains {
+		if !strings.Contains(string(body), s) {
+			failed = append(failed, fmt.Sprintf("body does not contain %q", s))
+		}
+	}
+	for _, s := range a.BodyNotContains {
+		if strings.Contains(string(body), s) {
+			failed = append(failed, fmt.Sprintf("body contains %q", s))
+		}
+	}
+	if !a.compiled {
+		var err error
+		if a, err = a.compile(); err != nil {
+			return append(failed, fmt.Sprintf("invalid regular expression : %v", err))
+		}
+	}
+	for i, re := range a.bodyMatches {
+		if !re.Match(body) {
+			failed = append(failed, fmt.Sprintf("body does not match %q", a.BodyMatches[i]))
+		}
+	}
+	for i, re := range a.bodyNotMatches {
+		if re.Match(body) {
+			failed = append(failed, fmt.Sprintf("body matches %q", a.BodyNotMatches[i]))
+		}
+	}
+
+	//JSON content
+	if len(a.JSON) > 0 {
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return append(failed, "body is not valid JSON")
+		}
+		for path, expected := range a.JSON {
+			value, err := evalJSONPath(doc, path)
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("json %s : %v", path, err))
+			} else if value != expected {
+				failed = append(failed, fmt.Sprintf("json %s is %s, expected %s", path, value, expected))
+			}
+		}
+	}
+	return failed
+}
+
+//parseStatusRule parses a status rule into an inclusive range of codes.
+func parseStatusRule(rule string) (int, int, error) {
+	rule = strings.TrimSpace(rule)
+	if len(rule) == 3 && strings.HasSuffix(strings.ToLower(rule), "xx") {
+		if class, err := strconv.Atoi(rule[:1]); err == nil {
+			return class * 100, class*100 + 99, nil
+		}
+	}
+	bounds := strings.SplitN(rule, "-", 2)
+	low, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("%q is not a valid status rule", rule)
+	}
+	if len(bounds) == 1 {
+		return low, low, nil
+	}
+	high, err := strconv.Atoi(strings.TrimSpace(bounds[1]))
+	if err != nil || high < low {
+		return 0, 0, fmt.Errorf("%q is not a valid status rule", rule)
+	}
+	return low, high, nil
+}
+
+//matchStatus tells whether a status code matches one of the status rules.
+func matchStatus(rules []string, code int) bool {
+	for _, r := range rules {
+		if low, high, err := parseStatusRule(r); err == nil && code >= low && code <= high {
+			return true
+		}
+	}
+	return false
+}
+
+//jsonPathToken matches a path element, i.e. a field name or an array index.
+var jsonPathToken = regexp.MustCompile(`^(?:\.?([^.\[\]]+)|\[(\d+)\])`)
+
+//parseJSONPath splits a simple JSON path, e.g. "$.items[0].id", into field names and array indexes.
+func parseJSONPath(path string) ([]interface{}, error) {
+	rest := strings.TrimPrefix(path, "$")
+	tokens := make([]interface{}, 0)
+	for rest != "" {
+		m := jsonPathToken.FindStringSubmatch(rest)
+		if m == nil {
+			return nil, fmt.Errorf("%q is not a valid JSON path", path)
+		}
+		if m[2] != "" {
+			i, _ := strconv.Atoi(m[2])
+			tokens = append(tokens, i)
+		} else {
+			tokens = append(tokens, m[1])
+		}
+		rest = rest[len(m[0]):]
+	}
+	return tokens, nil
+}
+
+//evalJSONPath returns the value found at a JSON path in a decoded document.
+//Strings are returned as is, other values are JSON encoded (e.g. "true", "42" or "null").
+func evalJSONPath(doc interface{}, path string) (string, error) {
+	tokens, err := parseJSONPath(path)
+	if err != nil {
+		return "", err
+	}
+	for _, t := range tokens {
+		switch t := t.(type) {
+		case string:
+			obj, ok := doc.(map[string]interface{})
+			if !ok {
+				return "", fmt.Errorf("%s is not an object field", t)
+			}
+			if doc, ok = obj[t]; !ok {
+				return "", fmt.Errorf("field %s not found", t)
+			}
+		case int:
+			arr, ok := doc.([]interface{})
+			if !ok || t >= len(arr) {
+				return "", fmt.Errorf("index %d not found", t)
+			}
+			doc = arr[t]
+		}
+	}
+	if s, ok := doc.(string); ok {
+		return s, nil
+	}
+	data, err := json.Marshal(doc)
+	return string(data), err
+}
@@ -0,0 +1,83 @@
+package micromon
+
+import (
+	"testing"
+	"time"
+)
+
+//benchSites and benchSamples define the size of the data set used by benchmarks : 10 websites checked every second for ~3 hours.
+const (
+	benchSites   = 10
+	benchSamples = 10000
+)
+
+//benchData builds a respMap filled with benchSamples MetaResponse per website, the newest being produced now.
+func benchData(r Retention) respMap {
+	now := time.Now()
+	datas := NewRespMap(benchSites)
+	for i := 0; i < benchSites; i++ {
+		d := NewBoundedSafeData(r)
+		for j := benchSamples; j > 0; j-- {
+			d.Add(MetaResponse{
+				Name:         "site",
+				Code:         200,
+				RespDuration: time.Duration(j%500) * time.Millisecond,
+				Timestamp:    now.Add(-time.Duration(j) * time.Second),
+				Available:    j%50 != 0,
+			})
+		}
+		datas[string(rune('a'+i))] = d
+	}
+	return datas
+}
+
+//linearSince is the former window selection, which scans all samples. It is kept as a reference for benchmarks.
+func linearSince(data []MetaResponse, duration time.Duration) []MetaResponse {
+	ret := make([]MetaResponse, 0)
+	now := time.Now()
+	for _, m := range data {
+		if now.Sub(m.Timestamp) <= duration {
+			ret = append(ret, m)
+		}
+	}
+	return ret
+}
+
+//BenchmarkWindow measures the selection of the last 2 minutes of samples in the ring buffer.
+func BenchmarkWindow(b *testing.B) {
+	d := benchData(Retention{})["a"]
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.Since(2 * time.Minute)
+	}
+}
+
+//BenchmarkLinearWindow measures the selection of the last 2 minutes of samples with a linear scan.
+func BenchmarkLinearWindow(b *testing.B) {
+	d := benchData(Retention{})["a"]
+	all := d.Since(benchSamples * time.Second)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		linearSince(all, 2*time.Minute)
+	}
+}
+
+//BenchmarkAdd measures the insertion of samples when the retention policy is reached, i.e. with eviction.
+func BenchmarkAdd(b *testing.B) {
+	d := benchData(Retention{MaxSamples: benchSamples})["a"]
+	now := time.Now()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.Add(MetaResponse{Timestamp: now.Add(time.Duration(i) * time.Millisecond), Available: true})
+	}
+}
+
+//BenchmarkComputeMetrics measures the computation of all provided metrics over the last 10 minutes for all websites.
+func BenchmarkComputeMetrics(b *testing.B) {
+	datas := benchData(Retention{})
+	metrics := []Metric{AvgRespTime{}, MaxRespTime{}, CodeCount{}, Availability{}}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		(&datas).ComputeMetrics(metrics, 10*time.Minute)
+	}
+}
@@ -0,0 +1,242 @@
+package micromon
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"time"
+)
+
+//TLSConf holds TLS settings of a Website. CAFile is the path to PEM encoded certificates trusted
+//in addition to the system ones, e.g. for self-signed certificates.
+type TLSConf struct {
+	CAFile string
+}
+
+//TLSInfo holds information about the TLS connection established with a website : negotiated version and cipher suite,
+//peer certificate chain (leaf first) and the error which occurred while verifying the chain, if any.
+type TLSInfo struct {
+	Version     string
+	CipherSuite string
+	Chain       []CertInfo
+	VerifyError string
+}
+
+//CertInfo holds information about a certificate.
+type CertInfo struct {
+	Subject   string
+	Issuer    string
+	NotBefore time.Time
+	NotAfter  time.Time
+	DNSNames  []string
+}
+
+//certPool returns the system certificate pool augmented with certificates of a PEM file, if any.
+func certPool(caFile string) (*x509.CertPool, error) {
+	if caFile == "" {
+		return nil, nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return pool, nil
+}
+
+//tlsClientConfig returns a TLS configuration which records the connection state in a MetaResponse.
+//Chain verification is performed by hand, after the connection state has been recorded, so that
+//certificates are known even when they are invalid.
+func tlsClientConfig(conf TLSConf, meta *MetaResponse) (*tls.Config, error) {
+	roots, err := certPool(conf.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			info := &TLSInfo{Version: tlsVersionName(cs.Version), CipherSuite: tls.CipherSuiteName(cs.CipherSuite)}
+			for _, c := range cs.PeerCertificates {
+				info.Chain = append(info.Chain, CertInfo{c.Subject.String(), c.Issuer.String(), c.NotBefore, c.NotAfter, c.DNSNames})
+			}
+			meta.TLS = info
+			if len(cs.PeerCertificates) == 0 {
+				info.VerifyError = "no peer certificate"
+				return errors.New(info.VerifyError)
+			}
+
+			opts := x509.VerifyOptions{Roots: roots, DNSName: cs.ServerName, Intermediates: x509.NewCertPool()}
+			for _, c := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(c)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			if err != nil {
+				info.VerifyError = err.Error()
+			}
+			return err
+		},
+	}, nil
+}
+
+//tlsVersionName returns a readable name of a TLS version.
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+//CertDaysRemaining implements Metric and computes the number of days before the first certificate of the chain expires.
+//It is computed from the most recent response which has a certificate chain, and is not computed if there is none (e.g. plain HTTP).
+type CertDaysRemaining struct{}
+
+func (CertDaysRemaining) Compute(data []MetaResponse) Result {
+	for i := len(data) - 1; i >= 0; i-- {
+		if data[i].TLS == nil || len(data[i].TLS.Chain) == 0 {
+			continue
+		}
+		expiry := data[i].TLS.Chain[0].NotAfter
+		for _, c := range data[i].TLS.Chain[1:] {
+			if c.NotAfter.Before(expiry) {
+				expiry = c.NotAfter
+			}
+		}
+		return MetricFloat(time.Until(expiry).Hours() / 24)
+	}
+	return nil
+}
+
+func (CertDaysRemaining) Description() string {
+	return "Days before certificate expiry"
+}
+
+func (CertDaysRemaining) Name() string {
+	return "certDaysRemaining"
+}
+
+//defaultCertThresholds are the numbers of days before certificate expiry at which CertHook alerts, if none are configured.
+var defaultCertThresholds = []int{30, 14, 3}
+
+//CertHook implements Hooker.
+//It provides a hook which alerts when a certificate expiry drops below each of the configured thresholds (in days, per website or global),
+//and when certificate validation fails, e.g. because of an unknown authority or a hostname mismatch.
+//Expiry relies on the certDaysRemaining metric, validation failures are known from failure reasons of the timeframe.
+//Alerts are only printed when the state of a website changes. As availability alerts, they are recorded as incidents,
+//of the "certificateExpiry" and "certificateInvalid" rules, and sent to all notifiers of the configuration.
+type CertHook struct {
+	alerting *alerting
+}
+
+//certState holds the last known certificate state of a website.
+type certState struct {
+	threshold int
+	invalid   bool
+}
+
+//crossedThreshold returns the lowest threshold which a number of days is below, or math.MaxInt32 if there is none.
+func crossedThreshold(days float64, thresholds []int) int {
+	crossed := math.MaxInt32
+	for _, t := range thresholds {
+		if days < float64(t) && t < crossed {
+			crossed = t
+		}
+	}
+	return crossed
+}
+
+func (c CertHook) GetHook(conf Config) Hook {
+	if c.alerting == nil {
+		c.alerting = newAlerting(conf)
+	}
+	//Resume ongoing incidents, e.g. after a restart, so that they are not notified again
+	states := make(map[string]certState)
+	for _, i := range c.alerting.incidents.Query(IncidentQuery{Ongoing: true}) {
+		state, known := states[i.Website]
+		if !known {
+			state = certState{threshold: math.MaxInt32}
+		}
+		switch i.Rule {
+		case "certificateExpiry":
+			state.threshold = crossedThreshold(i.Value, conf.certThresholds(i.Website))
+		case "certificateInvalid":
+			state.invalid = true
+		}
+		states[i.Website] = state
+	}
+	transition := func(a Alert) {
+		c.alerting.incidents.record(a, "")
+		c.alerting.notify(a, nil)
+	}
+
+	return func(metrics []WebMetrics) string {
+		now := time.Now()
+		res := ""
+		for _, s := range metrics {
+			//Certificates are checked by websites, not by groups
+			if s.Members != nil {
+				continue
+			}
+			prev, known := states[s.WebsiteName]
+			if !known {
+				prev = certState{threshold: math.MaxInt32}
+			}
+			state := prev
+			days, computed := 0.0, false
+			for _, m := range s.Metrics {
+				if out, ok := m.Output.(MetricFloat); ok {
+					if _, ok := m.Source.(CertDaysRemaining); ok {
+						days, computed = float64(out), true
+						//Lowest threshold crossed, with the thresholds of the website
+						state.threshold = crossedThreshold(days, conf.certThresholds(s.WebsiteName))
+					}
+				}
+			}
+			failures := s.failureReasons()
+			state.invalid = failures[string(FailureCertificate)] != nil || failures[string(FailureHostname)] != nil
+			states[s.WebsiteName] = state
+
+			alert := Alert{"certificateExpiry", "warning", s.WebsiteName, s.Labels, "firing", days, now, now}
+			if computed && state.threshold < prev.threshold {
+				log.Printf("==== CERTIFICATE ALERTS ====\nCertificate of website %v expires in %.1f days (less than %v days)\n\n", s.WebsiteName, days, state.threshold)
+				transition(alert)
+				res = "expiring"
+			} else if computed && state.threshold == math.MaxInt32 && prev.threshold != math.MaxInt32 {
+				log.Printf("==== CERTIFICATE ALERTS ====\nCertificate of website %v has been renewed, it expires in %.1f days\n\n", s.WebsiteName, days)
+				alert.State = "resolved"
+				transition(alert)
+				res = "renewed"
+			}
+
+			alert = Alert{"certificateInvalid", "critical", s.WebsiteName, s.Labels, "firing", 1, now, now}
+			if state.invalid && !prev.invalid {
+				log.Printf("==== CERTIFICATE ALERTS ====\nCertificate of website %v failed validation\n\n", s.WebsiteName)
+				transition(alert)
+				res = "invalid"
+			} else if !state.invalid && prev.invalid {
+				log.Printf("==== CERTIFICATE ALERTS ====\nCertificate of website %v is valid again\n\n", s.WebsiteName)
+				alert.State, alert.Value = "resolved", 0
+				transition(alert)
+			}
+		}
+
+		//For testing purposes
+		return res
+	}
+}
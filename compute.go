@@ -5,11 +5,17 @@ import (
 	"time"
 )
 
-//WebMetrics is a simple wrapper to associate a website name with its set of Metric and Result, for a given timeframe (in minutes)
+//WebMetrics is a simple wrapper to associate a website name with its set of Metric and Result, for a given timeframe
+//Labels are the labels of the website. For a group, WebsiteName is the name of the group, Labels its selector and Members
+//the names of its websites ; Members is nil otherwise.
+//Failures counts failure reasons in the timeframe, whatever the metrics computed, so that hooks can explain unavailabilities.
 type WebMetrics struct {
-	Timeframe   int
+	Timeframe   time.Duration
 	WebsiteName string
 	Metrics     []WebMetric
+	Labels      map[string]string
+	Members     []string
+	failures    MetricMap
 }
 
 //WebMetric associate a Metric with its Result.
@@ -21,11 +27,25 @@ type WebMetric struct {
 //respMap is just a map of website names associated with a safeData struct.
 type respMap map[string]*safeData
 
-//safeData is a slice of MetaResponse along with a mutex.
+//Retention defines how long and how many MetaResponse are kept for each website.
+//MaxAge is the age after which MetaResponse are dropped (integers are minutes in the configuration file). A zero value means no limit.
+//When Rollups is set, MetaResponse which age out are aggregated per minute, per hour and per day rather than dropped.
+type Retention struct {
+	MaxAge     MinuteDuration
+	MaxSamples int
+	Rollups    bool
+}
+
+//safeData is a time-ordered ring buffer of MetaResponse along with a mutex and a retention policy.
 //As data can be processed from multiple threads (e.g. feeding, removing old data, reading, etc.,), sync is a must have.
 type safeData struct {
-	Datas []MetaResponse
-	Mux   sync.Mutex
+	samples    ring
+	rollups    []rollupTier
+	lastRolled time.Time
+	retention  Retention
+	labels     map[string]string
+	labelsAt   time.Time
+	mux        sync.Mutex
 }
 
 //NewRespMap initializes a new respMap suited for a given number of websites.
@@ -33,49 +53,226 @@ func NewRespMap(size int) respMap {
 	return make(map[string]*safeData, size)
 }
 
-//NewSafeData initializes an empty safeData and returns a pointer to it.
+//NewSafeData initializes an empty safeData which keeps data forever and returns a pointer to it.
 func NewSafeData() *safeData {
-	return &safeData{Datas: make([]MetaResponse, 0)}
+	return &safeData{}
+}
+
+//NewBoundedSafeData initializes an empty safeData which drops data according to a Retention and returns a pointer to it.
+func NewBoundedSafeData(r Retention) *safeData {
+	d := &safeData{retention: r}
+	if r.Rollups {
+		d.rollups = newRollupTiers()
+	}
+	return d
+}
+
+//Add records a MetaResponse and drops samples which are not retained anymore.
+func (d *safeData) Add(m MetaResponse) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.samples.push(m)
+	//Labels of the newest response, which may have changed with the configuration
+	if !m.Timestamp.Before(d.labelsAt) {
+		d.labels, d.labelsAt = m.Labels, m.Timestamp
+	}
+	d.evict(time.Now())
+}
+
+//Labels returns the labels of the newest MetaResponse.
+func (d *safeData) Labels() map[string]string {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.labels
+}
+
+//evict drops the oldest samples exceeding the retention policy. The caller must hold the lock.
+func (d *safeData) evict(now time.Time) {
+	for d.retention.MaxSamples > 0 && d.samples.len() > d.retention.MaxSamples {
+		d.rollUp(d.samples.pop(), now)
+	}
+	maxAge := time.Duration(d.retention.MaxAge)
+	for maxAge > 0 && d.samples.len() > 0 && now.Sub(d.samples.at(0).Timestamp) > maxAge {
+		d.rollUp(d.samples.pop(), now)
+	}
+}
+
+//rollUp aggregates an evicted MetaResponse into rollups, if enabled. The caller must hold the lock.
+//MetaResponse already aggregated, e.g. replayed from a Store after restoring rollups, are ignored.
+func (d *safeData) rollUp(m MetaResponse, now time.Time) {
+	if d.rollups == nil || !m.Timestamp.After(d.lastRolled) {
+		return
+	}
+	rollUp(d.rollups, m, now)
+	d.lastRolled = m.Timestamp
+}
+
+//Since returns a copy of all MetaResponse produced in the last given duration.
+func (d *safeData) Since(span time.Duration) []MetaResponse {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.samples.since(time.Now().Add(-span))
+}
+
+//window returns a copy of all MetaResponse produced in the last given duration.
+//When rollups overlap the window, i.e. the window exceeds the raw data retention, it also returns the aggregate of
+//these rollups and of the raw data, along with true.
+func (d *safeData) window(span time.Duration) ([]MetaResponse, Rollup, bool) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	from := time.Now().Add(-span)
+	raw := d.samples.since(from)
+	if d.rollups == nil {
+		return raw, Rollup{}, false
+	}
+	agg, ok := rollupsSince(d.rollups, from)
+	if !ok {
+		return raw, Rollup{}, false
+	}
+	agg.merge(rollupOf(raw))
+	return raw, agg, true
+}
+
+//Rollups returns a copy of all rollups, from the oldest to the newest.
+func (d *safeData) Rollups() []Rollup {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	res := make([]Rollup, 0)
+	for i := len(d.rollups) - 1; i >= 0; i-- {
+		res = append(res, d.rollups[i].buckets...)
+	}
+	return res
+}
+
+//setRollups replaces rollups, e.g. when restored from a Store. Rollups are dispatched in tiers according to their span.
+//It returns the timestamp of the newest MetaResponse aggregated.
+func (d *safeData) setRollups(rollups []Rollup) time.Time {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.rollups == nil {
+		return d.lastRolled
+	}
+	d.rollups = newRollupTiers()
+	for _, r := range rollups {
+		for i := range d.rollups {
+			if d.rollups[i].span == r.Span {
+				d.rollups[i].buckets = append(d.rollups[i].buckets, r)
+			}
+		}
+		if r.Last.After(d.lastRolled) {
+			d.lastRolled = r.Last
+		}
+	}
+	return d.lastRolled
+}
+
+//Datas returns a copy of all MetaResponse currently held, from the oldest to the newest.
+//It replaces the former Datas field, which could not be bounded : responses are now added with Add, which locks by itself.
+func (d *safeData) Datas() []MetaResponse {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.samples.since(time.Time{})
+}
+
+//Len returns the number of MetaResponse currently held.
+func (d *safeData) Len() int {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.samples.len()
+}
+
+//Rollups returns a copy of the rollups of each website.
+func (s *respMap) Rollups() map[string][]Rollup {
+	res := make(map[string][]Rollup, len(*s))
+	for k, v := range *s {
+		res[k] = v.Rollups()
+	}
+	return res
+}
+
+//Restore reloads rollups and MetaResponse recorded in a Store into the respMap, as far as the retention policy goes.
+//MetaResponse produced since the newest restored rollup are replayed so that no data is missing from rollups.
+//Data of websites which are not in the respMap is ignored.
+func (s *respMap) Restore(store Store, r Retention) error {
+	since := time.Time{}
+	if r.MaxAge > 0 {
+		since = time.Now().Add(-time.Duration(r.MaxAge))
+	}
+	rollups, err := store.LoadRollups()
+	if err != nil {
+		return err
+	}
+	for k, v := range rollups {
+		if d, ok := (*s)[k]; ok && d.rollups != nil {
+			if last := d.setRollups(v); last.Before(since) {
+				since = last
+			}
+		}
+	}
+	return store.Replay(since, func(m MetaResponse) {
+		if d, ok := (*s)[m.Name]; ok {
+			d.Add(m)
+		}
+	})
+}
+
+//SiteMetrics holds the metrics to compute for each website : Sites holds the metrics of websites which override
+//the Default ones.
+type SiteMetrics struct {
+	Default []Metric
+	Sites   map[string][]Metric
+}
+
+//For returns the metrics to compute for a website.
+func (m SiteMetrics) For(name string) []Metric {
+	if metrics, ok := m.Sites[name]; ok {
+		return metrics
+	}
+	return m.Default
 }
 
 //ComputeMetrics compute multiple metrics for a given timeframe and return the packed result (each element corresponds to a website with its metrics).
 //It operates on a respMap struct, basically a set of websites names associated with multiple MetaResponse.
-func (s *respMap) ComputeMetrics(metrics []Metric, minutes int) []WebMetrics {
+//When the timeframe exceeds raw data retention, metrics implementing RollupMetric are computed from rollups, others only from raw data.
+func (s *respMap) ComputeMetrics(metrics []Metric, span time.Duration) []WebMetrics {
+	return s.ComputeSiteMetrics(SiteMetrics{Default: metrics}, span)
+}
+
+//ComputeSiteMetrics is like ComputeMetrics, but computes for each website the metrics it is configured with.
+func (s *respMap) ComputeSiteMetrics(metrics SiteMetrics, span time.Duration) []WebMetrics {
 	res := make([]WebMetrics, 0)
 
 	//Iterate over each website data
 	for k, v := range *s {
 		//Copy data within the given timeframe
-		v.Mux.Lock()
-		datas := since(&v.Datas, minutes)
-		v.Mux.Unlock()
+		datas, agg, rolled := v.window(span)
 
 		//If no data is available, do not compute
-		if len(datas) == 0 {
+		if len(datas) == 0 && !rolled {
 			continue
 		}
-		tempRes := WebMetrics{minutes, k, make([]WebMetric, 0)}
+		tempRes := WebMetrics{Timeframe: span, WebsiteName: k, Metrics: make([]WebMetric, 0), Labels: v.Labels()}
+		if rolled {
+			tempRes.failures = FailureReasons{}.ComputeRollup(agg).(MetricMap)
+		} else {
+			tempRes.failures = FailureReasons{}.Compute(datas).(MetricMap)
+		}
 
 		//For each metric asked, add result
-		for _, m := range metrics {
-			tempRes.Metrics = append(tempRes.Metrics, WebMetric{m, m.Compute(datas)})
+		for _, m := range metrics.For(k) {
+			var r Result
+			if rm, ok := m.(RollupMetric); ok && rolled {
+				r = rm.ComputeRollup(agg)
+			} else if len(datas) > 0 {
+				r = m.Compute(datas)
+			}
+			//Metric may not be applicable to this website
+			if r != nil {
+				tempRes.Metrics = append(tempRes.Metrics, WebMetric{m, r})
+			}
 		}
 
 		res = append(res, tempRes)
 	}
 	return res
 }
-
-//since selects and returns all MetaResponse produced in the last X minutes, X given in function parameters.
-func since(data *[]MetaResponse, minutes int) []MetaResponse {
-	ret := make([]MetaResponse, 0)
-	duration := time.Duration(time.Duration(minutes) * time.Minute)
-	now := time.Now()
-	for _, m := range *data {
-		//Data is recent enough, select it
-		if now.Sub(m.Timestamp) <= duration {
-			ret = append(ret, m)
-		}
-	}
-	return ret
-}
@@ -1,73 +1,274 @@
 package micromon
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
+	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
 
 //Config is a struct which mirrors the structure of the YAML configuration file.
 //It contains user customisable parameters, such as websites to visit and metrics to compute.
+//Templates are named partial websites : websites inherit the settings they do not set from the template they name.
+//Groups aggregate websites, e.g. the endpoints of a service, and are reported along with them.
+//Rules are alert rules evaluated on metrics of websites and groups, see Rule. Notifiers are the named channels
+//alerts are sent to, see NotifierConf. Incidents defines the history of alerts, see IncidentsConf.
+//Maintenance windows are planned periods during which websites are not alerted on, see MaintenanceWindow.
+//Silences are persisted to SilencesPath, by default "silences.json" in the storage directory with file storage.
 type Config struct {
 	Websites        map[string]Website
-	DefaultInterval int
-	Timeout         int
-	AvailThreshold  int
-	Metrics         []string
+	DefaultInterval Duration
+	Timeout         Duration
+	AvailThreshold  float64
+	Hysteresis      Hysteresis
+	CertThresholds  []int
+	Metrics         []MetricName
 	Hooks           []string
 	Format          string
 	Output          string
+	Timeframes      []Timeframe
+	PushListen      string
+	Retention       Retention
+	Storage         StorageConf
+	Templates       map[string]Website
+	Groups          map[string]Group
+	Rules           []Rule
+	Notifiers       map[string]NotifierConf
+	Incidents       IncidentsConf
+	Maintenance     []MaintenanceWindow
+	SilencesPath    string
 }
 
-//Website wraps an URL and a check interval.
+//MetricName is a metric entry of the configuration file. It is either a name, possibly followed by a parameter
+//(e.g. "percentile:95"), or a map associating a single name with its parameter (e.g. "percentile: 95").
+type MetricName string
+
+//UnmarshalYAML implements yaml.Unmarshaler and accepts both forms of metric entries.
+func (m *MetricName) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		*m = MetricName(name)
+		return nil
+	}
+	var params map[string]string
+	if err := unmarshal(&params); err != nil {
+		return err
+	}
+	if len(params) != 1 {
+		return fmt.Errorf("a metric must be a name or a single name with its parameter")
+	}
+	for k, v := range params {
+		*m = MetricName(k + ":" + v)
+	}
+	return nil
+}
+
+//Website wraps an URL and a check interval, along with the request to send.
+//Type selects the Prober used to check the website : "http" (default), "tcp", "dns" or "tls". The meaning of URL depends on it,
+//e.g. "host:port" for TCP and TLS, or a host name for DNS. Resolver is the address of the resolver used by DNS checks.
+//ReadBody makes checks download the response body, which is needed to measure transfer time.
+//Assertions define what a response must look like for the website to be considered available.
+//Steps make the check a multi-step transaction rather than a single request, see Step.
+//Websites of type "push" are not checked but ping MicroMon with their Token at least every Interval plus Grace.
+//Labels are arbitrary key-value pairs (e.g. service, environment) which are attached to responses and metrics.
+//Timeout, AvailThreshold, Hysteresis, CertThresholds and Metrics override the global settings for the website, and Hooks replaces
+//the global hooks for it. Any setting which is not set is inherited from the named Template, see Config.Templates.
 type Website struct {
-	URL      string
-	Interval int
+	Template   string
+	Type       string
+	URL        string
+	Interval   Duration
+	ReadBody   bool
+	Request    `yaml:",inline"`
+	Assertions Assertions
+	TLS        TLSConf
+	Resolver   string
+	Steps      []Step
+	Token      string
+	Grace      Duration
+	Labels     map[string]string
+	//Overrides of global settings
+	Timeout        Duration
+	AvailThreshold float64
+	Hysteresis     Hysteresis
+	CertThresholds []int
+	Metrics        []MetricName
+	Hooks          []string
 }
 
 //FetchConfig parses a YAML file which reflects MicroMon's configuration.
 //It takes an input path and return a Config object - or an error.
+//Unknown fields are rejected and the whole configuration is validated : all errors found are returned at once
+//as ConfigErrors, located by their line in the file. Once valid, secrets referenced by the configuration are resolved.
 func FetchConfig(path string) (Config, error) {
+	conf, v, err := validateConfig(path)
+	if err != nil {
+		return conf, err
+	}
+	if len(v.errs) == 0 {
+		conf = v.secrets(conf)
+	}
+	return conf, v.err()
+}
+
+//ValidateConfig is like FetchConfig, but does not resolve secrets : only the syntax of their references is checked,
+//so that a configuration can be validated where its secrets are not available, e.g. in CI.
+func ValidateConfig(path string) (Config, error) {
+	conf, v, err := validateConfig(path)
+	if err != nil {
+		return conf, err
+	}
+	return conf, v.err()
+}
+
+//validateConfig reads, decodes and validates a configuration file, without resolving secrets.
+//It returns the validator holding validation errors, or an error if the file cannot be read or parsed.
+func validateConfig(path string) (Config, *validator, error) {
 	conf := Config{}
 
 	//Read and decode configuration from file
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		return conf, err
+		return conf, nil, err
 	}
-	err = yaml.Unmarshal(data, &conf)
-	if err != nil {
-		return conf, err
+	v := &validator{data: data}
+	if err := yaml.UnmarshalStrict(data, &conf); err != nil {
+		//Syntax errors stop decoding, while decoding errors are collected along with validation ones
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			return conf, nil, err
+		}
+		for _, e := range typeErr.Errors {
+			v.addDecodeError(e)
+		}
+	}
+	v.config(conf)
+
+	//Apply templates before validating websites
+	websites, errs := applyTemplates(conf)
+	for k, err := range errs {
+		v.add(err, "websites", k, "template")
+	}
+	conf.Websites = websites
+	for k, g := range conf.Groups {
+		if _, ok := conf.Websites[k]; ok {
+			v.addf([]string{"groups", k}, "a website has the same name")
+		}
+		if err := g.validate(conf); err != nil {
+			v.add(err, "groups", k)
+		}
+		for i, m := range g.Metrics {
+			if _, err := GetMetric(string(m)); err != nil {
+				v.add(err, "groups", k, "metrics", strconv.Itoa(i))
+			}
+		}
 	}
+	v.rules(conf)
 
-	//Set default interval for unspecified check intervals
-	for k, v := range conf.Websites {
+	//Validate websites and set default interval for unspecified check intervals
+	tokens := make(map[string]bool)
+	for k, w := range conf.Websites {
 		//Workaround because we cannot assign to struct field in map, so copy struct, make change, assign strut
-		tmp := conf.Websites[k]
-		if v.Interval == 0 {
+		tmp := w
+		if err := checkSecrets(w.Request); err != nil {
+			v.add(err, "websites", k)
+		}
+		if w.Type == "push" {
+			if err := checkSecret(w.Token); err != nil || w.Token == "" || (!isSecret(w.Token) && strings.Contains(w.Token, "/")) {
+				v.addf([]string{"websites", k, "token"}, "push websites need a valid token")
+			} else if !isSecret(w.Token) {
+				//Tokens referencing secrets are checked once resolved
+				if tokens[w.Token] {
+					v.addf([]string{"websites", k, "token"}, "token is already used")
+				}
+				tokens[w.Token] = true
+			}
+		} else if _, err := GetProber(w.Type); err != nil {
+			v.add(err, "websites", k, "type")
+		} else if err := websiteURL(w); err != nil {
+			v.add(err, "websites", k, "url")
+		}
+		if err := w.Assertions.validate(); err != nil {
+			v.add(err, "websites", k, "assertions")
+		}
+		if _, err := certPool(w.TLS.CAFile); err != nil {
+			v.add(err, "websites", k, "tls", "cafile")
+		}
+		extracted := make(map[string]bool)
+		for i, step := range w.Steps {
+			if err := step.validate(extracted); err != nil {
+				v.add(err, "websites", k, "steps", strconv.Itoa(i))
+			}
+			for _, e := range step.Extract {
+				extracted[e.Var] = true
+			}
+			if err := checkSecrets(step.Request); err != nil {
+				v.add(err, "websites", k, "steps", strconv.Itoa(i))
+			}
+		}
+		if w.Interval == 0 {
 			tmp.Interval = conf.DefaultInterval
-			conf.Websites[k] = tmp
 		}
+		if tmp.Interval <= 0 {
+			v.addf([]string{"websites", k, "interval"}, "must be positive, set it or set defaultinterval")
+		}
+		if w.Grace < 0 {
+			v.addf([]string{"websites", k, "grace"}, "must not be negative")
+		}
+		v.overrides(conf, w, "websites", k)
+		conf.Websites[k] = tmp
 	}
-	return conf, err
+	return conf, v, nil
 }
 
-//GetConfig returns a Config fetched from the path given in parameter.
-func GetConfig(path string) Config {
-	conf, err := FetchConfig(path)
-	if err != nil {
-		log.Fatalf("Error fetching configuration : %v", err)
+//GetRetention returns the retention policy from the configuration.
+//When no maximum age is set, raw data is kept as long as the widest timeframe or rule window needs it,
+//up to a day if rollups are enabled.
+func GetRetention(conf Config) Retention {
+	r := conf.Retention
+	if r.MaxAge == 0 {
+		for _, tf := range GetTimeframes(conf) {
+			if tf.Span > r.MaxAge {
+				r.MaxAge = tf.Span
+			}
+		}
+		for _, rule := range getRules(conf) {
+			if rule.Window > r.MaxAge {
+				r.MaxAge = rule.Window
+			}
+		}
+		if r.Rollups && r.MaxAge > defaultRollupRawAge {
+			r.MaxAge = defaultRollupRawAge
+		}
 	}
-	return conf
+	return r
 }
 
 //GetMetrics returns instances of Metric from the configuration.
 func GetMetrics(conf Config) []Metric {
+	return getMetrics(conf.Metrics)
+}
+
+//GetSiteMetrics returns instances of Metric from the configuration, for all websites : websites may override global metrics.
+func GetSiteMetrics(conf Config) SiteMetrics {
+	m := SiteMetrics{Default: GetMetrics(conf), Sites: make(map[string][]Metric)}
+	for name, w := range conf.Websites {
+		if len(w.Metrics) > 0 {
+			m.Sites[name] = getMetrics(w.Metrics)
+		}
+	}
+	return m
+}
+
+//getMetrics returns instances of Metric from their names.
+func getMetrics(names []MetricName) []Metric {
 	metrics := make([]Metric, 0)
 	//Try to instantiate each metric
-	for _, v := range conf.Metrics {
-		met, err := GetMetric(v)
+	for _, v := range names {
+		met, err := GetMetric(string(v))
 		if err != nil {
 			log.Printf("Warning : %v", err)
 		} else {
@@ -79,39 +280,45 @@ func GetMetrics(conf Config) []Metric {
 
 //GetHooks returns instances of Hook from the configuration.
 func GetHooks(conf Config) []Hook {
+	return getHooks(conf, conf.Hooks, newAlerting(conf))
+}
+
+//getHooks is like GetHooks, but hooks which alert send their alerts to the given notifiers and incident history.
+//Defaults are the hooks applied to websites which do not list hooks.
+func getHooks(conf Config, defaults []string, a *alerting) []Hook {
 	hooks := make([]Hook, 0)
 	//Try to instantiate each hook : get the Hooker and the Hook closure with closed-config.
 	for _, v := range conf.Hooks {
-		h, err := GetHook(v, conf)
+		h, err := getHook(v, conf, a)
 		if err != nil {
 			log.Printf("Warning : %v", err)
 		} else {
-			hooks = append(hooks, h)
+			hooks = append(hooks, websitesHook(v, conf, defaults, h))
 		}
 	}
 	return hooks
 }
 
-//GetReporter builds a reporter from the configuration
-func GetReporter(conf Config) Reporter {
-	var f Formatter
-	var l *log.Logger
-
+//GetReporter builds a reporter from the configuration.
+//It returns a non-nil error if the format is unknown or if the output file cannot be opened.
+func GetReporter(conf Config) (Reporter, error) {
 	//Get formatter
-	switch conf.Format {
-	case "xml":
-		f = XMLFormatter{}
-	default:
-		f = DefaultFormatter{}
+	f, err := getFormatter(conf.Format)
+	if err != nil {
+		return Reporter{}, err
 	}
 
 	//Get logger
 	switch conf.Output {
 	case "":
-		l = DefaultLogger()
+		return NewReporter(DefaultLogger(), f), nil
 	default:
-		l = FileLogger(conf.Output)
+		out, err := openOutput(conf.Output)
+		if err != nil {
+			return Reporter{}, err
+		}
+		r := NewReporter(log.New(out, "", 0), f)
+		r.out = out
+		return r, nil
 	}
-
-	return NewReporter(l, f)
 }
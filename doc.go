@@ -12,7 +12,8 @@ We briefly explain the main concepts below.
 Types
 
 MicroMon defines five main types : Config, MetaResponse, Metric, Hook and Reporter, along with secondary types.
-Config holds the application configuration. MetaResponse holds the meta-informations from a website HTTP response.
+Config holds the application configuration. MetaResponse holds the meta-informations from a website HTTP response,
+or from any other kind of check performed by a Prober (TCP connection, DNS lookup, TLS handshake).
 Metric is an interface which defines a method to aggregate MetaResponses, and Hook is a closure meant to do extra work on metrics.
 Reporter allow to customize the formatting and the writing of computed metrics.
 
@@ -34,15 +35,48 @@ Hooks
 Hooks are a way to do extra work on computed metrics without causing side-effects and without impacting reporting. Typically, alerting logic
 is a hook. Hook are implemented as closures which operate on metrics and are meant to be called after metrics have been computed
 and before metrics have been reported. Any extra work/logging should be implemented as a hook.
+The alert hook smooths availability alerts with hysteresis : separate trigger and recovery thresholds, a number of
+consecutive evaluations before changing state, and flap detection which suspends notifications until a website is stable.
+
+Timeframes
+
+Metrics are computed over timeframes, i.e. named windows with a span and a computation period. Each timeframe is driven by a Schedule,
+which feeds its own hooks and reporter, so that a short window may only feed alerting hooks while a long one is written to a file.
+
+Storage
+
+Responses are kept in memory in a time-ordered ring buffer per website, bounded by a retention policy. A Store may also record them,
+e.g. in append-only segment files, so that history is reloaded when MicroMon restarts.
 
 Usage
 
 The method Start(path) is provided to handle all the monitoring logic. It takes a path to a YAML configuration file, which defines
 websites to watch, metrics to computes, hooks to call and reporter to use, along with other parameters. This is the most easy way
-to monitor websites.
+to monitor websites. The configuration is strictly validated : unknown fields and invalid values are all reported at once
+with their line, as ConfigErrors ; ValidateConfig does so without resolving secrets. Websites may override the global timeout,
+availability threshold, certificate thresholds, metrics and hooks, and inherit settings from named templates, so that each
+website is checked and alerted on its own terms.
+Websites may carry labels, which are attached to their responses and metrics. Groups aggregate websites, by name or by labels,
+and are reported along with them : the availability of a group is the share of time during which all, any or a quorum of
+its members were up, and other metrics are computed over the responses of all members.
+Alert rules compare a metric of websites or groups to a threshold, e.g. "p95 > 800ms for 5m" or "codeCount[5xx] > 3",
+over their own window : a rule is pending while its condition holds, firing once it has held long enough, and resolved
+when it does not hold anymore. Transitions of rules, availability and certificate alerts are sent to notifiers : webhooks, emails
+and local commands. They are also recorded as incidents in a bounded history, persisted along with storage, which
+can be queried with Monitor.Incidents or the micromon incidents command.
+Maintenance windows, one-off or recurring on a cron-style schedule, mark checks of their websites as maintenance, may
+exclude them from availability, and suppress notifications. Silences suppress notifications of selected alerts until
+they expire ; they are added with Monitor.Silence or the micromon silence command.
+
+Programs embedding MicroMon rather use a Monitor, built with NewMonitor from a Config. Its Run method blocks until the given context
+is cancelled or Stop is called : in-flight checks are then aborted, metrics of each timeframe are reported a last time,
+and storage and reporters are closed. The micromon command stops this way on SIGINT and SIGTERM.
+A running Monitor can be given a new configuration with Reload : only websites which configuration changed are restarted,
+history of the others is kept, and metrics, hooks and reporters are rebuilt. An invalid configuration is rejected and the
+current one keeps running. The micromon command reloads its configuration file on SIGHUP, or when it changes with the -watch flag.
 
 But it is possible to do it without a configuration file by using the methods exposed by the package, as showed in examples section.
-See app.go for a complete example of monitoring.
+See monitor.go for a complete example of monitoring.
 
 Examples
 
@@ -55,22 +89,23 @@ This example shows how to get a single MetaResponse from a website.
 This example shows how to collect responses from a website without computing any metric.
 
 	//Websites to watch and check intervals
-	webs := map[string]Website{"github": Website{"https://github.com", 3}}
+	webs := map[string]Website{"github": Website{URL: "https://github.com", Interval: Duration(3 * time.Second)}}
 
-	//Get response channel
-	ch := WatchWebsites(Config{Websites: webs})
+	//Get response channel, closed when the context is cancelled
+	ch, err := WatchWebsites(context.Background(), Config{Websites: webs})
 
 
 	//Gather incoming responses
 	data := NewSafeData()
-	for {
-		resp := <-ch
+	for resp := range ch {
 		fmt.Printf("%v\n", resp)
-		data.Mux.Lock()
-		data.Datas = append(data.Datas, resp)
-		data.Mux.Unlock()
+		data.Add(resp)
 	}
 
+Responses used to be appended to the exported Datas slice of a safeData, under its exported Mux. These fields have been
+removed so that retention can bound memory : responses are added with Add, and read with Datas, which returns a copy
+of all of them, or Since.
+
 The following example shows how to compute and print a specific metric given a slice of MetaResponse.
 
 	//Suppose that resp is fed with MetaResponse
@@ -87,13 +122,14 @@ In this example we write metrics formatted with XML in a log file.
 	var data := NewRespMap(5)
 
 	//Build reporter
-	rep := NewReporter(FileLogger("output.log"), XMLFormatter{})
+	logger, err := FileLogger("output.log")
+	rep := NewReporter(logger, XMLFormatter{})
 
 	//Metrics to compute
 	met := []Metric{AvgRespTime{}, Availability{}}
 
 	//Compute metrics for the last two minutes
-	res := (&data).ComputeMetrics(met, 2)
+	res := (&data).ComputeMetrics(met, 2*time.Minute)
 
 	//Write XML results in log file
 	rep.Report(res)
@@ -0,0 +1,88 @@
+package micromon
+
+import (
+	"fmt"
+	"time"
+)
+
+//Duration is a duration of the configuration file, such as a check interval or a timeout.
+//It is written as a Go duration string (e.g. "500ms", "30s", "2m") or, for backward compatibility, as an integer of seconds.
+type Duration time.Duration
+
+//MinuteDuration is a Duration which integers are minutes, as historically for timeframe spans and retention ages.
+type MinuteDuration time.Duration
+
+//MillisecondDuration is a Duration which integers are milliseconds, as historically for maximum response times.
+type MillisecondDuration time.Duration
+
+//UnmarshalYAML implements yaml.Unmarshaler and accepts duration strings and integers of seconds.
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	v, err := unmarshalDuration(unmarshal, time.Second)
+	*d = Duration(v)
+	return err
+}
+
+//UnmarshalYAML implements yaml.Unmarshaler and accepts duration strings and integers of minutes.
+func (d *MinuteDuration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	v, err := unmarshalDuration(unmarshal, time.Minute)
+	*d = MinuteDuration(v)
+	return err
+}
+
+//UnmarshalYAML implements yaml.Unmarshaler and accepts duration strings and integers of milliseconds.
+func (d *MillisecondDuration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	v, err := unmarshalDuration(unmarshal, time.Millisecond)
+	*d = MillisecondDuration(v)
+	return err
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d MinuteDuration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d MillisecondDuration) String() string {
+	return time.Duration(d).String()
+}
+
+//unmarshalDuration decodes a duration string, or an integer expressed in the given unit.
+//Other values, including fractional numbers which would be truncated, are rejected.
+func unmarshalDuration(unmarshal func(interface{}) error, unit time.Duration) (time.Duration, error) {
+	var v interface{}
+	if err := unmarshal(&v); err != nil {
+		return 0, err
+	}
+	switch n := v.(type) {
+	case int:
+		return time.Duration(n) * unit, nil
+	case string:
+		return time.ParseDuration(n)
+	}
+	return 0, fmt.Errorf("a duration must be a string such as \"30s\" or an integer of %v", unitName(unit))
+}
+
+//unitName returns the name of a duration unit.
+func unitName(unit time.Duration) string {
+	switch unit {
+	case time.Minute:
+		return "minutes"
+	case time.Millisecond:
+		return "milliseconds"
+	}
+	return "seconds"
+}
+
+//spanString returns a human-readable description of a timeframe span : "10 minutes" for whole minutes, e.g. "30s" otherwise.
+//It reads after "last", e.g. "last minute".
+func spanString(d time.Duration) string {
+	if d == time.Minute {
+		return "minute"
+	}
+	if d > 0 && d%time.Minute == 0 {
+		return fmt.Sprintf("%d minutes", d/time.Minute)
+	}
+	return d.String()
+}
@@ -0,0 +1,134 @@
+package micromon
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"syscall"
+)
+
+//FailureReason classifies why a website has been considered unavailable.
+type FailureReason string
+
+//Known failure reasons. A successful check has an empty FailureReason.
+//Job and missed failures are reported by push websites, when a job pings a failure or when no ping is received in time.
+//Request failures are reported by transactions, when the request of a step cannot be built.
+const (
+	FailureDNS         FailureReason = "dns"
+	FailureRefused     FailureReason = "refused"
+	FailureTimeout     FailureReason = "timeout"
+	FailureTLS         FailureReason = "tls"
+	FailureCertificate FailureReason = "certificate"
+	FailureHostname    FailureReason = "hostname"
+	FailureNetwork     FailureReason = "network"
+	FailureTransfer    FailureReason = "transfer"
+	FailureAssertion   FailureReason = "assertion"
+	FailureJob         FailureReason = "job"
+	FailureMissed      FailureReason = "missed"
+	FailureRequest     FailureReason = "request"
+)
+
+//handshakeError wraps an error returned by a TLS handshake, so that it is classified as a TLS failure
+//even when crypto/tls does not type it, e.g. an unsupported protocol version.
+type handshakeError struct {
+	err error
+}
+
+func (e handshakeError) Error() string {
+	return "TLS handshake failed : " + e.err.Error()
+}
+
+func (e handshakeError) Unwrap() error {
+	return e.err
+}
+
+//classifyError returns the FailureReason corresponding to an error returned while performing a request.
+func classifyError(err error) FailureReason {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var hsErr handshakeError
+	var authErr x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var certErr x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &dnsErr):
+		return FailureDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return FailureRefused
+	case errors.As(err, &hostErr):
+		return FailureHostname
+	case errors.As(err, &authErr), errors.As(err, &certErr), errors.As(err, &verifyErr):
+		return FailureCertificate
+	case errors.As(err, &recordErr), errors.As(err, &alertErr):
+		return FailureTLS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return FailureTimeout
+	case errors.As(err, &hsErr):
+		return FailureTLS
+	}
+	return FailureNetwork
+}
+
+//FailureReasons implements Metric and RollupMetric and counts occurrences of each FailureReason among unavailabilities.
+type FailureReasons struct{}
+
+func (FailureReasons) Compute(data []MetaResponse) Result {
+	res := make(MetricMap)
+	for _, m := range data {
+		if !m.Available {
+			res[string(m.Failure)] = addMetricInt(res[string(m.Failure)], 1)
+		}
+	}
+	return res
+}
+
+func (FailureReasons) ComputeRollup(r Rollup) Result {
+	res := make(MetricMap)
+	for k, v := range r.Failures {
+		res[k] = MetricInt(v)
+	}
+	return res
+}
+
+func (FailureReasons) Description() string {
+	return "Failure reasons counts"
+}
+
+func (FailureReasons) Name() string {
+	return "failureReasons"
+}
+
+//addMetricInt adds a number to a Result which is expected to be a MetricInt, or nil.
+func addMetricInt(r Result, n int) MetricInt {
+	i, _ := r.(MetricInt)
+	return i + MetricInt(n)
+}
+
+//failureReasons returns the counts of failure reasons in the timeframe of WebMetrics, or the computed
+//FailureReasons metric for WebMetrics which have not been computed from responses.
+func (w WebMetrics) failureReasons() MetricMap {
+	if w.failures != nil {
+		return w.failures
+	}
+	for _, m := range w.Metrics {
+		if counts, ok := m.Output.(MetricMap); ok && m.Source.Name() == (FailureReasons{}).Name() {
+			return counts
+		}
+	}
+	return nil
+}
+
+//dominantFailure returns the most frequent failure reason in the timeframe of WebMetrics, if any.
+func dominantFailure(w WebMetrics) string {
+	reason, max := "", MetricInt(0)
+	for k, v := range w.failureReasons() {
+		if c, ok := v.(MetricInt); ok && (c > max || (c == max && k < reason)) {
+			reason, max = k, c
+		}
+	}
+	return reason
+}
@@ -0,0 +1,220 @@
+package micromon
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+//Group aggregates websites, selected by name with Websites and by labels with Labels : websites which have all of
+//the labels are members as well. Mode tells when the group is up : when "all" of its members are up (default),
+//when "any" of them is, or when a "quorum" of at least Quorum members is. Metrics are computed over the responses
+//of all members and default to the global ones.
+type Group struct {
+	Websites []string
+	Labels   map[string]string
+	Mode     string
+	Quorum   int
+	Metrics  []MetricName
+}
+
+//WebGroup is a Group which members are resolved from a configuration, along with its metrics instances.
+type WebGroup struct {
+	Name    string
+	Members []string
+	Labels  map[string]string
+	Metrics []Metric
+	Avail   GroupAvailability
+}
+
+//GroupAvailability implements Metric and computes the time-weighted availability of a group : the share of time during
+//which enough members were up, according to the mode of the group. The state of a member is the one of its last response.
+//Accounting starts once all members have responded, or at the first response if some never did : members which did not
+//respond are then ignored, e.g. in "all" mode the group is up when all members which responded are up.
+type GroupAvailability struct {
+	Mode    string
+	Quorum  int
+	Members int
+}
+
+//GetGroups returns the groups of the configuration with their members, ordered by name.
+func GetGroups(conf Config) []WebGroup {
+	groups := make([]WebGroup, 0, len(conf.Groups))
+	for name, g := range conf.Groups {
+		members := g.members(conf)
+		names := g.Metrics
+		if len(names) == 0 {
+			names = conf.Metrics
+		}
+		metrics := make([]Metric, 0)
+		for _, m := range getMetrics(names) {
+			//Availability of members is replaced by the one of the group
+			if _, ok := m.(Availability); !ok {
+				metrics = append(metrics, m)
+			}
+		}
+		groups = append(groups, WebGroup{name, members, g.Labels, metrics, GroupAvailability{g.Mode, g.Quorum, len(members)}})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups
+}
+
+//members returns the sorted names of the websites of the configuration which belong to the group.
+func (g Group) members(conf Config) []string {
+	members := make([]string, 0)
+	for name, w := range conf.Websites {
+		if contains(g.Websites, name) || (len(g.Labels) > 0 && hasLabels(w.Labels, g.Labels)) {
+			members = append(members, name)
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+//validate checks the mode of the group and that it has members.
+func (g Group) validate(conf Config) error {
+	for _, w := range g.Websites {
+		if _, ok := conf.Websites[w]; !ok {
+			return fmt.Errorf("%s is not a known website", w)
+		}
+	}
+	n := len(g.members(conf))
+	if n == 0 {
+		return fmt.Errorf("group has no member")
+	}
+	switch g.Mode {
+	case "", "all", "any":
+	case "quorum":
+		if g.Quorum <= 0 || g.Quorum > n {
+			return fmt.Errorf("quorum must be between 1 and the number of members (%d)", n)
+		}
+	default:
+		return fmt.Errorf("%s is not a known group mode", g.Mode)
+	}
+	return nil
+}
+
+//hasLabels tells whether labels contain all of the wanted ones.
+func hasLabels(labels map[string]string, wanted map[string]string) bool {
+	for k, v := range wanted {
+		if l, ok := labels[k]; !ok || l != v {
+			return false
+		}
+	}
+	return true
+}
+
+//ComputeGroupMetrics computes the metrics of groups for a given timeframe, over the raw responses of their members.
+//Groups which members have no data are not reported.
+func (s *respMap) ComputeGroupMetrics(groups []WebGroup, span time.Duration) []WebMetrics {
+	res := make([]WebMetrics, 0)
+	for _, g := range groups {
+		datas := make([]MetaResponse, 0)
+		for _, name := range g.Members {
+			if d, ok := (*s)[name]; ok {
+				datas = append(datas, d.Since(span)...)
+			}
+		}
+		if len(datas) == 0 {
+			continue
+		}
+		tempRes := WebMetrics{Timeframe: span, WebsiteName: g.Name, Labels: g.Labels, Members: g.Members}
+		tempRes.failures = FailureReasons{}.Compute(datas).(MetricMap)
+		for _, m := range append([]Metric{g.Avail}, g.Metrics...) {
+			if r := m.Compute(datas); r != nil {
+				tempRes.Metrics = append(tempRes.Metrics, WebMetric{m, r})
+			}
+		}
+		res = append(res, tempRes)
+	}
+	return res
+}
+
+func (g GroupAvailability) Compute(data []MetaResponse) Result {
+	//Responses excluded from availability by maintenance windows do not change the state of members
+	sorted := make([]MetaResponse, 0, len(data))
+	for _, m := range data {
+		if !m.ExcludedFromAvailability {
+			sorted = append(sorted, m)
+		}
+	}
+	if len(sorted) == 0 {
+		return nil
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Timestamp.Before(sorted[j].Timestamp) })
+
+	//Start once all members have a known state
+	first := make(map[string]time.Time)
+	for _, m := range sorted {
+		if _, ok := first[m.Name]; !ok {
+			first[m.Name] = m.Timestamp
+		}
+	}
+	start := sorted[0].Timestamp
+	if len(first) >= g.Members {
+		for _, t := range first {
+			if t.After(start) {
+				start = t
+			}
+		}
+	}
+
+	//Sweep responses, weighting the state of the group by its duration
+	states := make(map[string]bool)
+	var upTime, total time.Duration
+	var prev time.Time
+	up, started := false, false
+	for _, m := range sorted {
+		if started {
+			d := m.Timestamp.Sub(prev)
+			total += d
+			if up {
+				upTime += d
+			}
+		}
+		states[m.Name] = m.Available
+		if !m.Timestamp.Before(start) {
+			started = true
+			prev = m.Timestamp
+			up = g.up(states)
+		}
+	}
+	if total == 0 {
+		if up {
+			return MetricFloat(100)
+		}
+		return MetricFloat(0)
+	}
+	return MetricFloat(float64(upTime) / float64(total) * 100)
+}
+
+//up tells whether the group is up given the states of its members.
+func (g GroupAvailability) up(states map[string]bool) bool {
+	n := 0
+	for _, s := range states {
+		if s {
+			n++
+		}
+	}
+	switch g.Mode {
+	case "any":
+		return n > 0
+	case "quorum":
+		return n >= g.Quorum
+	}
+	return n == len(states)
+}
+
+func (g GroupAvailability) Description() string {
+	mode := g.Mode
+	if mode == "" {
+		mode = "all"
+	} else if mode == "quorum" {
+		mode = fmt.Sprintf("quorum of %d", g.Quorum)
+	}
+	return fmt.Sprintf("Group availability (%%, %s of %d members up)", mode, g.Members)
+}
+
+func (GroupAvailability) Name() string {
+	return "groupAvailability"
+}
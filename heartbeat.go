@@ -0,0 +1,187 @@
+package micromon
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//defaultPushListen is the address of the push endpoint when none is configured.
+const defaultPushListen = ":8081"
+
+//heartbeat holds the state of a push website, i.e. a website which pings MicroMon rather than being checked.
+//lastPing is the time of the last success or failure ping, started is the time of a pending start ping.
+//Pings are signalled on reset, so that the deadline of the next ping is rearmed.
+type heartbeat struct {
+	name     string
+	website  Website
+	lastPing time.Time
+	started  time.Time
+	reset    chan struct{}
+}
+
+//heartbeats receives pings of push websites, identified by their token, and turns them into MetaResponse.
+//The map of websites is never modified once the endpoint is served, the mutex protects heartbeats states.
+type heartbeats struct {
+	mux   sync.Mutex
+	sites map[string]*heartbeat
+	ch    chan MetaResponse
+	ctx   context.Context
+}
+
+//watchHeartbeats serves the push endpoint for push websites of the configuration, and watches that each of them
+//pings at least once every interval plus a grace period. Otherwise, an unavailable MetaResponse is sent to the channel.
+//Endpoints are /ping/<token> for success, /ping/<token>/fail for failure and /ping/<token>/start to measure job duration.
+//The endpoint is shut down when the context is cancelled, and goroutines are tracked by the WaitGroup.
+//A non-nil error is returned if the endpoint address cannot be listened to.
+func watchHeartbeats(ctx context.Context, conf Config, ch chan MetaResponse, wg *sync.WaitGroup) error {
+	h := &heartbeats{sites: make(map[string]*heartbeat), ch: ch, ctx: ctx}
+	now := time.Now()
+	for name, website := range conf.Websites {
+		if website.Type == "push" {
+			//Leave a full period to the first ping
+			h.sites[website.Token] = &heartbeat{name: name, website: website, lastPing: now, reset: make(chan struct{}, 1)}
+		}
+	}
+	if len(h.sites) == 0 {
+		return nil
+	}
+
+	addr := conf.PushListen
+	if addr == "" {
+		addr = defaultPushListen
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("cannot serve push endpoint : %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping/", h.handlePing)
+	server := &http.Server{Handler: mux}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := server.Serve(l); err != http.ErrServerClosed {
+			log.Printf("Warning : push endpoint stopped : %v", err)
+		}
+	}()
+	//Wait for in-flight pings before closing the channel
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	for _, hb := range h.sites {
+		wg.Add(1)
+		go func(hb *heartbeat) {
+			defer wg.Done()
+			h.watch(hb)
+		}(hb)
+	}
+	return nil
+}
+
+//handlePing handles a ping of a push website.
+func (h *heartbeats) handlePing(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/ping/"), "/")
+	kind := ""
+	if len(parts) == 2 {
+		kind = parts[1]
+	}
+
+	hb, ok := h.sites[parts[0]]
+	if !ok || len(parts) > 2 || (kind != "" && kind != "start" && kind != "fail") {
+		http.NotFound(w, r)
+		return
+	}
+
+	h.mux.Lock()
+	now := time.Now()
+	if kind == "start" {
+		hb.started = now
+		h.mux.Unlock()
+		hb.rearm()
+	} else {
+		meta := MetaResponse{URL: hb.website.URL, Name: hb.name, Labels: hb.website.Labels, Timestamp: now, Available: kind != "fail"}
+		//Job duration
+		if !hb.started.IsZero() {
+			meta.RespDuration = now.Sub(hb.started)
+		}
+		if kind == "fail" {
+			meta.Failure = FailureJob
+			meta.Error = "job reported a failure"
+		}
+		hb.lastPing = now
+		hb.started = time.Time{}
+		h.mux.Unlock()
+		hb.rearm()
+		if !h.send(meta) {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Write([]byte("OK\n"))
+}
+
+//send sends a MetaResponse to the channel, unless the context is cancelled. It returns whether the MetaResponse has been sent.
+func (h *heartbeats) send(meta MetaResponse) bool {
+	select {
+	case h.ch <- meta:
+		return true
+	case <-h.ctx.Done():
+		return false
+	}
+}
+
+//rearm signals a ping to the watching goroutine, without blocking if a signal is already pending.
+func (hb *heartbeat) rearm() {
+	select {
+	case hb.reset <- struct{}{}:
+	default:
+	}
+}
+
+//watch sends an unavailable MetaResponse as soon as a push website has not pinged for its interval plus its grace period,
+//then once per interval until it pings again. It returns when the context is cancelled.
+func (h *heartbeats) watch(hb *heartbeat) {
+	period := time.Duration(hb.website.Interval)
+	grace := time.Duration(hb.website.Grace)
+	h.mux.Lock()
+	timer := time.NewTimer(time.Until(hb.lastPing.Add(period + grace)))
+	h.mux.Unlock()
+	defer timer.Stop()
+	for {
+		fired := false
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-hb.reset:
+		case <-timer.C:
+			fired = true
+		}
+		h.mux.Lock()
+		now := time.Now()
+		last := hb.lastPing
+		h.mux.Unlock()
+		deadline := last.Add(period + grace)
+		if !now.Before(deadline) {
+			if fired {
+				h.send(MetaResponse{URL: hb.website.URL, Name: hb.name, Labels: hb.website.Labels, Timestamp: now, Failure: FailureMissed, Error: "no ping since " + last.Format("2006/01/02 15:04:05")})
+			}
+			deadline = now.Add(period)
+		}
+		if !fired && !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(deadline))
+	}
+}
@@ -0,0 +1,137 @@
+package micromon
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//defaultHistogramBounds are the upper bounds, in milliseconds, of latency histogram buckets when none are configured.
+var defaultHistogramBounds = []float64{50, 100, 250, 500, 1000, 2500, 5000}
+
+//histogramBarWidth is the width of the widest bar when a histogram is formatted on multiple lines.
+const histogramBarWidth = 30
+
+//XMLResult is implemented by Results which have a structured XML representation rather than a single value.
+type XMLResult interface {
+	//XML returns the XML representation of the Result.
+	XML() string
+}
+
+//MetricHistogram implements Result and XMLResult and represents a distribution.
+//Counts[i] is the number of values lower or equal to Bounds[i] and greater than the previous bound.
+//The last count is the number of values greater than the last bound.
+type MetricHistogram struct {
+	Bounds []float64
+	Counts []int
+}
+
+//NewMetricHistogram returns an empty MetricHistogram with given sorted upper bounds.
+func NewMetricHistogram(bounds []float64) MetricHistogram {
+	return MetricHistogram{bounds, make([]int, len(bounds)+1)}
+}
+
+//Observe counts a value in the bucket it belongs to.
+func (h *MetricHistogram) Observe(v float64, count int) {
+	h.Counts[sort.SearchFloat64s(h.Bounds, v)] += count
+}
+
+//bound returns the upper bound of the i-th bucket, "+Inf" for the last one.
+func (h MetricHistogram) bound(i int) string {
+	if i == len(h.Bounds) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(h.Bounds[i], 'f', -1, 64)
+}
+
+//label returns a readable label for the i-th bucket, e.g. "<=100" or ">1000" for the last one.
+func (h MetricHistogram) label(i int) string {
+	if i == len(h.Bounds) && i > 0 {
+		return ">" + h.bound(i-1)
+	}
+	return "<=" + h.bound(i)
+}
+
+func (h MetricHistogram) Format(inline bool) string {
+	if inline {
+		buckets := make([]string, len(h.Counts))
+		for i, c := range h.Counts {
+			buckets[i] = fmt.Sprintf("%v : %v", h.label(i), c)
+		}
+		return "[" + strings.Join(buckets, ", ") + "]"
+	}
+
+	//One line per bucket, with a bar proportional to the count
+	max := 1
+	for _, c := range h.Counts {
+		if c > max {
+			max = c
+		}
+	}
+	var res string
+	for i, c := range h.Counts {
+		res += fmt.Sprintf("%-8v %6v %v\n", h.label(i), c, strings.Repeat("#", c*histogramBarWidth/max))
+	}
+	return res
+}
+
+func (h MetricHistogram) XML() string {
+	res := "<histogram>"
+	for i, c := range h.Counts {
+		res += fmt.Sprintf("<bucket><le>%v</le><count>%v</count></bucket>", h.bound(i), c)
+	}
+	return res + "</histogram>"
+}
+
+//LatencyHistogram implements Metric and RollupMetric and computes the distribution of response times (ms).
+//Bounds are the upper bounds of buckets, in milliseconds.
+type LatencyHistogram struct {
+	Bounds []float64
+}
+
+//NewLatencyHistogram builds a LatencyHistogram from a comma-separated list of bucket bounds, e.g. "100,250,500".
+//An empty parameter means default bounds.
+func NewLatencyHistogram(param string) (LatencyHistogram, error) {
+	if param == "" {
+		return LatencyHistogram{defaultHistogramBounds}, nil
+	}
+	bounds := make([]float64, 0)
+	for _, b := range strings.Split(param, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(b), 64)
+		if err != nil || v <= 0 || (len(bounds) > 0 && v <= bounds[len(bounds)-1]) {
+			return LatencyHistogram{}, fmt.Errorf("%q is not a valid list of increasing histogram bounds", param)
+		}
+		bounds = append(bounds, v)
+	}
+	return LatencyHistogram{bounds}, nil
+}
+
+func (l LatencyHistogram) Compute(data []MetaResponse) Result {
+	h := NewMetricHistogram(l.Bounds)
+	for _, m := range data {
+		if m.Available {
+			h.Observe(float64(m.RespDuration)/float64(time.Millisecond), 1)
+		}
+	}
+	return h
+}
+
+func (l LatencyHistogram) ComputeRollup(r Rollup) Result {
+	//Each sketch bucket is counted at its estimated value
+	h := NewMetricHistogram(l.Bounds)
+	h.Observe(0, r.Latency.Zeros)
+	for k, c := range r.Latency.Buckets {
+		h.Observe(float64(sketchValue(k))/float64(time.Millisecond), c)
+	}
+	return h
+}
+
+func (LatencyHistogram) Description() string {
+	return "Response time distribution (ms)"
+}
+
+func (LatencyHistogram) Name() string {
+	return "latencyHistogram"
+}
@@ -24,92 +24,215 @@ type Hook func([]WebMetrics) string
 //GetHook takes the name of a hook and a Config and returns the associated hook.
 //If no hook corresponding to name is found, a non-nil error is returned.
 func GetHook(name string, conf Config) (Hook, error) {
+	return getHook(name, conf, newAlerting(conf))
+}
+
+//getHook is like GetHook, but hooks which alert send their alerts to the given notifiers and incident history.
+func getHook(name string, conf Config, a *alerting) (Hook, error) {
 	switch name {
 	case "alert":
-		return AlertHook{}.GetHook(conf), nil
+		return AlertHook{a}.GetHook(conf), nil
+	case "cert":
+		return CertHook{a}.GetHook(conf), nil
 	}
 	return nil, fmt.Errorf("%s is not a known hook name", name)
 }
 
+//alerting holds what alert transitions are sent to : notifiers and the incident history, along with the maintenance
+//windows and silences which suppress notifications. It is shared by the hooks of all schedules of a configuration.
+type alerting struct {
+	notifiers    *notifiers
+	incidents    *IncidentHistory
+	maintenances []*maintenance
+	silences     *Silences
+}
+
+//newAlerting returns the notifiers and maintenance windows of the configuration, along with an incident history and
+//silences kept in memory.
+func newAlerting(conf Config) *alerting {
+	return &alerting{getNotifiers(conf), &IncidentHistory{}, getMaintenances(conf), &Silences{}}
+}
+
+//suppressedBy describes what suppresses notifications of an alert : a maintenance window of its website or a silence.
+//It returns "" if the alert may be notified.
+func (a *alerting) suppressedBy(alert Alert) string {
+	if m := inMaintenance(a.maintenances, alert.Website, alert.Labels, alert.At); m != nil {
+		return "maintenance window " + m.Name
+	}
+	if s, ok := a.silences.match(alert, alert.At); ok {
+		return "silence " + s.ID
+	}
+	return ""
+}
+
+//notify sends an alert to the given notifiers, or to all of them if none is given, unless the website is in maintenance
+//or the alert is silenced. It returns true if the alert has been sent.
+func (a *alerting) notify(alert Alert, names []string) bool {
+	if by := a.suppressedBy(alert); by != "" {
+		log.Printf("Notification of %s on %s suppressed by %s", alert.Rule, alert.Website, by)
+		return false
+	}
+	a.notifiers.send(alert, names)
+	return true
+}
+
 //AlertHook is an empty struct which implements Hooker.
-//It provides a hook which manages the alerting logic when websites availability is behind a threshold.
-//The hook, being a closure, can keep trace of previous alerts and keep them on screen.
-//Alerts are printed in standard output and do not use classic Reporter struct.
-type AlertHook struct{}
-
-//webDown is an internal struct to hold information about a website unavailability.
-type webDown struct {
-	name          string
-	when          time.Time
-	avail         float64
-	recovered     bool
-	whenRecovered time.Time
+//It provides a hook which manages the alerting logic when websites availability is behind a threshold,
+//the threshold of the website if it has one or the global one otherwise. Hysteresis settings smooth state changes.
+//Alerts are printed in standard output when a website goes down or recovers, and do not use classic Reporter struct.
+//Alerts also mention the most frequent failure reason of the timeframe.
+//Unavailabilities are recorded as incidents of the "availability" rule, which are ongoing until recovery, even across
+//restarts if the incident history is persisted. They are also sent to all notifiers of the configuration,
+//unless the website is flapping. A website still down at the end of a maintenance window or a silence is notified then.
+type AlertHook struct {
+	alerting *alerting
 }
 
-//addUnavailability is called when a website is unavailable. It records a new unavailability
-//in the webDown slice if no old unavailability concerning this website is still unrecovered.
-//It returns a boolean which indicates if a new unavailability has been effectively recorded and a slice describing all previous unavailabilities.
-func addUnavailability(s []webDown, name string, avail float64, when time.Time) ([]webDown, bool) {
-	for i := len(s) - 1; i >= 0; i-- {
-		//There is still an alert for this website, don't add one
-		if s[i].name == name && !s[i].recovered {
-			return s, false
-		}
+//Hysteresis smooths availability alerts. A website is down once its availability has been below the availability threshold,
+//and recovers once it has been at least RecoveryThreshold (the availability threshold by default), for Consecutive
+//evaluations in a row (1 by default). A website which changed state FlapChanges times within its last FlapWindow
+//evaluations (10 by default) is flapping : its alerts are not notified until its state has not changed for FlapWindow
+//evaluations. Flap detection is disabled unless FlapChanges is set.
+type Hysteresis struct {
+	RecoveryThreshold float64
+	Consecutive       int
+	FlapWindow        int
+	FlapChanges       int
+}
+
+//defaultFlapWindow is the number of evaluations flap detection looks at, if none is configured.
+const defaultFlapWindow = 10
+
+//availState is the alerting state of a website : whether it is down and since when, how many evaluations in a row
+//called for the other state, whether its state changed in the last evaluations, and the state last notified.
+//Suppressed is what suppressed the notification of the current state, if any, so that it is logged once.
+type availState struct {
+	down       bool
+	since      time.Time
+	streak     int
+	changes    []bool
+	flapping   bool
+	notified   bool
+	suppressed string
+}
+
+//evaluate updates the state of a website with its availability. It returns true if the state changed.
+func (st *availState) evaluate(avail float64, threshold float64, h Hysteresis, now time.Time) bool {
+	if (!st.down && avail < threshold) || (st.down && avail >= h.RecoveryThreshold) {
+		st.streak++
+	} else {
+		st.streak = 0
+	}
+	if st.streak < h.Consecutive {
+		return false
 	}
-	//Here, there is no alert, add one
-	return append(s, webDown{name, when, avail, false, time.Time{}}), true
+	st.down, st.since, st.streak = !st.down, now, 0
+	return true
 }
 
-//recoverAvailability is called when a website is available. If a previous unavailability concerning this website has
-//not been recovered yet, it recovers it. It returns a boolean which indicates if a unavailability has been effectively
-//recovered, along with a slice describing all previous unavailabilities.
-func recoverAvailability(s []webDown, name string, when time.Time) ([]webDown, bool) {
-	for i := len(s) - 1; i >= 0; i-- {
-		//This website was effectively not available ; recover it
-		if s[i].name == name && !s[i].recovered {
-			s[i].recovered = true
-			s[i].whenRecovered = when
-			return s, true
+//flap records whether the state changed for flap detection. It returns true if the website started or stopped flapping.
+func (st *availState) flap(changed bool, h Hysteresis) bool {
+	if h.FlapChanges <= 0 {
+		return false
+	}
+	st.changes = append(st.changes, changed)
+	if len(st.changes) > h.FlapWindow {
+		st.changes = st.changes[len(st.changes)-h.FlapWindow:]
+	}
+	n := 0
+	for _, c := range st.changes {
+		if c {
+			n++
 		}
 	}
-	return s, false
+	if !st.flapping && n >= h.FlapChanges {
+		st.flapping = true
+		return true
+	}
+	if st.flapping && n == 0 && len(st.changes) == h.FlapWindow {
+		st.flapping = false
+		return true
+	}
+	return false
 }
 
-func (AlertHook) GetHook(conf Config) Hook {
-	threshold := conf.AvailThreshold
-	memories := make([]webDown, 0)
+func (a AlertHook) GetHook(conf Config) Hook {
+	if a.alerting == nil {
+		a.alerting = newAlerting(conf)
+	}
+	//Resume ongoing incidents, e.g. after a restart
+	states := make(map[string]*availState)
+	for _, i := range a.alerting.incidents.Query(IncidentQuery{Rule: "availability", Ongoing: true}) {
+		states[i.Website] = &availState{down: true, since: i.Start, notified: true}
+	}
+
 	return func(metrics []WebMetrics) string {
 		now := time.Now()
 		res := ""
-		effect := false
 		//For each website, check if it just became available OR unavailable
 		for _, s := range metrics {
 			for _, m := range s.Metrics {
-				//If the availability has been computed, check its status
-				if _, ok := m.Source.(Availability); ok {
-					//Behind threshold, register unavailability
-					if avail, ok := m.Output.(MetricFloat); ok && avail < MetricFloat(threshold) {
-						memories, effect = addUnavailability(memories, s.WebsiteName, float64(avail), now)
-						if effect {
-							res = "unavailable"
+				//If the availability of the website or of the group has been computed, check its status
+				switch m.Source.(type) {
+				case Availability, GroupAvailability:
+					avail, ok := m.Output.(MetricFloat)
+					if !ok {
+						continue
+					}
+					st, known := states[s.WebsiteName]
+					if !known {
+						st = &availState{}
+						states[s.WebsiteName] = st
+					}
+					h := conf.hysteresis(s.WebsiteName)
+					changed := st.evaluate(float64(avail), conf.availThreshold(s.WebsiteName), h, now)
+					alert := Alert{"availability", "critical", s.WebsiteName, s.Labels, "resolved", float64(avail), st.since, now}
+					if st.down {
+						alert.State = "firing"
+					}
+					if changed {
+						st.suppressed = ""
+					}
+					if changed && st.down {
+						//Behind threshold, record unavailability
+						reason := dominantFailure(s)
+						a.alerting.incidents.record(alert, reason)
+						msg := fmt.Sprintf("Website %v is down. Availability = %v%%, time = %v", s.WebsiteName, strconv.FormatFloat(float64(avail), 'f', 3, 64), now.Format("2006/01/02 15:04:05"))
+						if reason != "" {
+							msg += fmt.Sprintf("\n\tReason = %v", reason)
 						}
-					} else {
-						memories, effect = recoverAvailability(memories, s.WebsiteName, now)
-						if effect {
-							res = "recovered"
+						log.Printf("==== AVAILABILITY ALERTS ====\n%v\n\n", msg)
+						res = "unavailable"
+					} else if changed {
+						msg := fmt.Sprintf("Website %v recovered", s.WebsiteName)
+						//The incident may have been ended meanwhile, e.g. by a reload, and has no duration then
+						if inc, ok := a.alerting.incidents.record(alert, ""); ok {
+							msg += fmt.Sprintf(" after %v", inc.Duration().Round(time.Second))
+						}
+						log.Printf("==== AVAILABILITY ALERTS ====\n%v. Time = %v\n\n", msg, now.Format("2006/01/02 15:04:05"))
+						res = "recovered"
+					}
+					if st.flap(changed, h) {
+						if st.flapping {
+							log.Printf("==== AVAILABILITY ALERTS ====\nWebsite %v is flapping, notifications are suspended\n\n", s.WebsiteName)
+							res = "flapping"
+						} else {
+							log.Printf("==== AVAILABILITY ALERTS ====\nWebsite %v is not flapping anymore\n\n", s.WebsiteName)
 						}
 					}
-				}
-			}
-		}
 
-		//Print all availabilities
-		for _, m := range memories {
-			msg := fmt.Sprintf("Website %v is down. Availability = %v%%, time = %v\n", m.name, strconv.FormatFloat(float64(m.avail), 'f', 3, 64), m.when.Format("2006/02/01 15:04:05"))
-			if m.recovered {
-				msg += fmt.Sprintf("\tRecovered. Time = %v", m.whenRecovered.Format("2006/02/01 15:04:05"))
+					//Notify the state once it is stable, and once its suppression is over
+					if !st.flapping && st.down != st.notified {
+						if by := a.alerting.suppressedBy(alert); by == "" {
+							a.alerting.notifiers.send(alert, nil)
+							st.notified, st.suppressed = st.down, ""
+						} else if by != st.suppressed {
+							log.Printf("Notification of %s on %s suppressed by %s", alert.Rule, alert.Website, by)
+							st.suppressed = by
+						}
+					}
+				}
 			}
-			log.Printf("==== AVAILABILITY ALERTS ====\n%v\n\n", msg)
 		}
 
 		//For testing purposes
@@ -0,0 +1,244 @@
+package micromon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//IncidentsConf defines the incident history. Path is the file it is persisted to, by default "incidents.json" in the
+//storage directory with file storage ; it is kept in memory otherwise. Incidents which ended more than MaxAge ago
+//(30 days by default) are dropped, and only the MaxCount (1000 by default) most recent ones are kept.
+type IncidentsConf struct {
+	Path     string
+	MaxAge   Duration
+	MaxCount int
+}
+
+//Default incident history settings.
+const (
+	incidentsFile            = "incidents.json"
+	defaultIncidentsMaxAge   = Duration(30 * 24 * time.Hour)
+	defaultIncidentsMaxCount = 1000
+)
+
+//Incident is a period during which an alert fired for a website or a group : availability alerts of the alert hook,
+//recorded as the "availability" rule, or alert rules. End is zero while the incident is ongoing.
+//Value is the value of the metric when the incident started, and Reason the most frequent failure reason, if known.
+type Incident struct {
+	Rule     string
+	Severity string
+	Website  string
+	Labels   map[string]string
+	Start    time.Time
+	End      time.Time
+	Value    float64
+	Reason   string
+}
+
+//Ongoing tells whether the incident has not ended yet.
+func (i Incident) Ongoing() bool {
+	return i.End.IsZero()
+}
+
+//Duration returns the duration of the incident, up to now if it is ongoing.
+func (i Incident) Duration() time.Duration {
+	if i.Ongoing() {
+		return time.Since(i.Start)
+	}
+	return i.End.Sub(i.Start)
+}
+
+func (i Incident) String() string {
+	msg := fmt.Sprintf("[%s] %s on %s since %v", i.Severity, i.Rule, i.Website, i.Start.Format("2006/01/02 15:04:05"))
+	if i.Ongoing() {
+		msg += fmt.Sprintf(", ongoing (%v)", i.Duration().Round(time.Second))
+	} else {
+		msg += fmt.Sprintf(" to %v (%v)", i.End.Format("2006/01/02 15:04:05"), i.Duration().Round(time.Second))
+	}
+	msg += ". Value = " + strconv.FormatFloat(i.Value, 'f', 3, 64)
+	if i.Reason != "" {
+		msg += ", reason = " + i.Reason
+	}
+	return msg
+}
+
+//IncidentQuery selects incidents : Website and Rule must match if set, incidents must not have ended before Since,
+//and must be ongoing if Ongoing is set.
+type IncidentQuery struct {
+	Website string
+	Rule    string
+	Since   time.Time
+	Ongoing bool
+}
+
+//match tells whether an incident is selected by the query.
+func (q IncidentQuery) match(i Incident) bool {
+	return (q.Website == "" || q.Website == i.Website) && (q.Rule == "" || q.Rule == i.Rule) &&
+		(i.Ongoing() || !i.End.Before(q.Since)) && (!q.Ongoing || i.Ongoing())
+}
+
+//IncidentHistory is a bounded history of incidents, ordered by start time and persisted to a file after each change
+//if it has a path. It is safe for concurrent use. Its zero value is an unbounded history kept in memory.
+type IncidentHistory struct {
+	path      string
+	maxAge    time.Duration
+	maxCount  int
+	incidents []Incident
+	mux       sync.Mutex
+}
+
+//incidentsPath returns the path of the file the incident history is persisted to, or "" if it is kept in memory.
+func incidentsPath(conf Config) string {
+	if conf.Incidents.Path != "" {
+		return conf.Incidents.Path
+	}
+	if conf.Storage.Type == "file" {
+		return filepath.Join(conf.Storage.Path, incidentsFile)
+	}
+	return ""
+}
+
+//OpenIncidentHistory opens the incident history of the configuration, loading persisted incidents if any.
+//It returns a non-nil error if persisted incidents cannot be read.
+func OpenIncidentHistory(conf Config) (*IncidentHistory, error) {
+	h := &IncidentHistory{
+		path:     incidentsPath(conf),
+		maxAge:   time.Duration(conf.Incidents.MaxAge),
+		maxCount: conf.Incidents.MaxCount,
+	}
+	if h.maxAge == 0 {
+		h.maxAge = time.Duration(defaultIncidentsMaxAge)
+	}
+	if h.maxCount == 0 {
+		h.maxCount = defaultIncidentsMaxCount
+	}
+	if h.path == "" {
+		return h, nil
+	}
+	data, err := ioutil.ReadFile(h.path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &h.incidents); err != nil {
+		return nil, fmt.Errorf("cannot read incidents from %s : %v", h.path, err)
+	}
+	h.prune(time.Now())
+	return h, nil
+}
+
+//Persistent tells whether incidents are persisted to a file.
+func (h *IncidentHistory) Persistent() bool {
+	return h.path != ""
+}
+
+//Query returns a copy of the incidents selected by a query, from the oldest to the newest.
+func (h *IncidentHistory) Query(q IncidentQuery) []Incident {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	res := make([]Incident, 0)
+	for _, i := range h.incidents {
+		if q.match(i) {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+//record records an alert transition : a firing alert starts an incident, unless one is already ongoing for the rule and
+//the website, and a resolved alert ends it. It returns the incident along with true if it has been started or ended.
+func (h *IncidentHistory) record(a Alert, reason string) (Incident, bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	i := h.ongoing(a.Rule, a.Website)
+	switch {
+	case a.State == "firing" && i < 0:
+		h.incidents = append(h.incidents, Incident{a.Rule, a.Severity, a.Website, a.Labels, a.Since, time.Time{}, a.Value, reason})
+		i = len(h.incidents) - 1
+	case a.State == "resolved" && i >= 0:
+		h.incidents[i].End = a.At
+	default:
+		if i >= 0 {
+			return h.incidents[i], false
+		}
+		return Incident{}, false
+	}
+	inc := h.incidents[i]
+	h.prune(a.At)
+	h.save()
+	return inc, true
+}
+
+//resolve ends ongoing incidents which are not active anymore, e.g. because their rule or website has been removed.
+func (h *IncidentHistory) resolve(active func(Incident) bool, at time.Time) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	changed := false
+	for i := range h.incidents {
+		if h.incidents[i].Ongoing() && !active(h.incidents[i]) {
+			h.incidents[i].End = at
+			changed = true
+		}
+	}
+	if changed {
+		h.save()
+	}
+}
+
+//ongoing returns the index of the ongoing incident of a rule for a website, or -1. The caller must hold the lock.
+func (h *IncidentHistory) ongoing(rule string, website string) int {
+	for i := len(h.incidents) - 1; i >= 0; i-- {
+		if h.incidents[i].Rule == rule && h.incidents[i].Website == website && h.incidents[i].Ongoing() {
+			return i
+		}
+	}
+	return -1
+}
+
+//prune drops incidents which ended before the maximum age, then the oldest ended ones beyond the maximum count.
+//Ongoing incidents are never dropped. The caller must hold the lock.
+func (h *IncidentHistory) prune(now time.Time) {
+	kept := h.incidents[:0]
+	for _, i := range h.incidents {
+		if i.Ongoing() || h.maxAge == 0 || now.Sub(i.End) <= h.maxAge {
+			kept = append(kept, i)
+		}
+	}
+	for excess := len(kept) - h.maxCount; h.maxCount > 0 && excess > 0; {
+		j := 0
+		for j < len(kept) && kept[j].Ongoing() {
+			j++
+		}
+		if j == len(kept) {
+			break
+		}
+		kept = append(kept[:j], kept[j+1:]...)
+		excess--
+	}
+	h.incidents = kept
+	sort.SliceStable(h.incidents, func(i, j int) bool { return h.incidents[i].Start.Before(h.incidents[j].Start) })
+}
+
+//save persists incidents, if the history has a path. Errors are logged as warnings. The caller must hold the lock.
+func (h *IncidentHistory) save() {
+	if h.path == "" {
+		return
+	}
+	data, err := json.Marshal(h.incidents)
+	if err == nil {
+		err = writeAtomic(h.path, data)
+	}
+	if err != nil {
+		log.Printf("Warning : cannot save incidents : %v", err)
+	}
+}
@@ -1,20 +1,218 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"github.com/Chostakovitch/micromon"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
+	//Validate configuration and exit : micromon validate [-c path]
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		validate(os.Args[2:])
+	}
+	//Print recorded incidents and exit : micromon incidents [-c path] [-website name] [-rule name] [-since duration] [-ongoing]
+	if len(os.Args) > 1 && os.Args[1] == "incidents" {
+		incidents(os.Args[2:])
+	}
+	//Manage silences and exit : micromon silence [-c path] [-list] [-expire id] [-for duration -comment text [-website names] [-label k=v] [-rule names]]
+	if len(os.Args) > 1 && os.Args[1] == "silence" {
+		silence(os.Args[2:])
+	}
+
 	//Handle command-line flags
 	testing := flag.Bool("test", false, "Set the flag to run tests")
+	bench := flag.Bool("bench", false, "Set the flag to run benchmarks")
 	confPath := flag.String("c", "mm.conf", "Path to the configuration file")
+	watch := flag.Duration("watch", 0, "Reload the configuration file when it changes, checking at the given period (e.g. 5s, 0 to disable)")
 	flag.Parse()
 
 	//Run in test mode : assert tests
 	if *testing {
 		micromon.LaunchTests()
+	} else if *bench {
+		micromon.LaunchBenchmarks()
 	} else {
-		micromon.Start(*confPath)
+		conf, err := micromon.FetchConfig(*confPath)
+		if err != nil {
+			log.Fatalf("Error fetching configuration : %v", err)
+		}
+		m, err := micromon.NewMonitor(conf)
+		if err != nil {
+			log.Fatalf("Error starting MicroMon : %v", err)
+		}
+
+		//Stop gracefully on interruption, flushing a final report, and reload configuration on hangup
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		go func() {
+			for s := range sig {
+				if s == syscall.SIGHUP {
+					reload(m, *confPath)
+					continue
+				}
+				log.Printf("Received %v, stopping", s)
+				m.Stop()
+			}
+		}()
+		//The file is not watched anymore once the monitor is stopped
+		ctx, cancel := context.WithCancel(context.Background())
+		if *watch > 0 {
+			go watchFile(ctx, m, *confPath, *watch)
+		}
+		err = m.Run(ctx)
+		cancel()
+		if err != nil {
+			log.Fatalf("Error running MicroMon : %v", err)
+		}
+	}
+}
+
+//reload reloads the configuration file, keeping the running one if the new one is invalid.
+func reload(m *micromon.Monitor, path string) {
+	if err := m.ReloadFile(path); err != nil {
+		log.Printf("Configuration rejected, keeping the current one : %v", err)
+	}
+}
+
+//watchFile reloads the configuration file each time its modification time changes, until the context is cancelled.
+func watchFile(ctx context.Context, m *micromon.Monitor, path string, every time.Duration) {
+	var last time.Time
+	if info, err := os.Stat(path); err == nil {
+		last = info.ModTime()
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil || info.ModTime().Equal(last) {
+				continue
+			}
+			last = info.ModTime()
+			reload(m, path)
+		}
+	}
+}
+
+//validate checks a configuration file, printing all its errors, and exits with a non-zero status if it is invalid.
+func validate(args []string) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	confPath := flags.String("c", "mm.conf", "Path to the configuration file")
+	flags.Parse(args)
+	if _, err := micromon.ValidateConfig(*confPath); err != nil {
+		fmt.Fprintf(os.Stderr, "%s is invalid :\n%v\n", *confPath, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s is valid\n", *confPath)
+	os.Exit(0)
+}
+
+//incidents prints the incidents of the persisted incident history selected by flags, from the oldest to the newest.
+func incidents(args []string) {
+	flags := flag.NewFlagSet("incidents", flag.ExitOnError)
+	confPath := flags.String("c", "mm.conf", "Path to the configuration file")
+	website := flags.String("website", "", "Only print incidents of this website or group")
+	rule := flags.String("rule", "", "Only print incidents of this rule, e.g. availability")
+	since := flags.Duration("since", 0, "Only print incidents which were ongoing during this last duration (e.g. 24h, 0 for all)")
+	ongoing := flags.Bool("ongoing", false, "Only print ongoing incidents")
+	flags.Parse(args)
+
+	conf, err := micromon.FetchConfig(*confPath)
+	if err != nil {
+		log.Fatalf("Error fetching configuration : %v", err)
+	}
+	history, err := micromon.OpenIncidentHistory(conf)
+	if err != nil {
+		log.Fatalf("Error opening incident history : %v", err)
+	}
+	if !history.Persistent() {
+		log.Fatalf("Incident history is not persisted : set incidents path or use file storage")
+	}
+	q := micromon.IncidentQuery{Website: *website, Rule: *rule, Ongoing: *ongoing}
+	if *since > 0 {
+		q.Since = time.Now().Add(-*since)
+	}
+	for _, i := range history.Query(q) {
+		fmt.Println(i)
+	}
+	os.Exit(0)
+}
+
+//silence adds, lists or expires silences of the persisted silences, which a running MicroMon loads as soon as they change.
+func silence(args []string) {
+	flags := flag.NewFlagSet("silence", flag.ExitOnError)
+	confPath := flags.String("c", "mm.conf", "Path to the configuration file")
+	list := flags.Bool("list", false, "List silences which have not expired")
+	expire := flags.String("expire", "", "End the silence which has this ID")
+	duration := flags.Duration("for", 0, "Silence alerts for this duration (e.g. 2h)")
+	comment := flags.String("comment", "", "Why alerts are silenced")
+	websites := flags.String("website", "", "Comma-separated websites or groups to silence, all if none")
+	labels := flags.String("label", "", "Comma-separated labels of websites to silence, e.g. env=prod")
+	rules := flags.String("rule", "", "Comma-separated rules to silence, e.g. availability, all if none")
+	flags.Parse(args)
+
+	conf, err := micromon.FetchConfig(*confPath)
+	if err != nil {
+		log.Fatalf("Error fetching configuration : %v", err)
+	}
+	silences, err := micromon.OpenSilences(conf)
+	if err != nil {
+		log.Fatalf("Error opening silences : %v", err)
+	}
+	if !silences.Persistent() {
+		log.Fatalf("Silences are not persisted : set silencespath or use file storage")
+	}
+
+	switch {
+	case *list:
+		for _, s := range silences.List() {
+			fmt.Println(s)
+		}
+	case *expire != "":
+		if err := silences.Expire(*expire); err != nil {
+			log.Fatalf("Error expiring silence : %v", err)
+		}
+	default:
+		if *duration <= 0 || *comment == "" {
+			log.Fatalf("A silence needs a positive duration (-for) and a comment (-comment)")
+		}
+		s := micromon.Silence{Websites: splitList(*websites), Rules: splitList(*rules), End: time.Now().Add(*duration), Comment: *comment}
+		for _, l := range splitList(*labels) {
+			kv := strings.SplitN(l, "=", 2)
+			if len(kv) != 2 {
+				log.Fatalf("Label %s is not of the form key=value", l)
+			}
+			if s.Labels == nil {
+				s.Labels = make(map[string]string)
+			}
+			s.Labels[kv[0]] = kv[1]
+		}
+		if s, err = silences.Add(s); err != nil {
+			log.Fatalf("Error adding silence : %v", err)
+		}
+		fmt.Println(s)
+	}
+	os.Exit(0)
+}
+
+//splitList splits a comma-separated list, ignoring empty elements.
+func splitList(s string) []string {
+	res := make([]string, 0)
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			res = append(res, e)
+		}
 	}
+	return res
 }
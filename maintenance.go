@@ -0,0 +1,440 @@
+package micromon
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//MaintenanceWindow is a planned maintenance of websites, selected by name or by labels, all websites being selected
+//if none is given. A one-off window lasts from Start to End (e.g. "2026-10-20 22:00" in local time, or RFC 3339),
+//a recurring one lasts Duration from each time matching its cron-style Schedule ("minute hour day-of-month month
+//day-of-week" in local time, e.g. "0 3 * * 0" for 3 AM every Sunday).
+//Checks of websites during a window are marked as maintenance, and alerts are not notified. With ExcludeAvailability,
+//these checks do not count in the availability of websites either.
+type MaintenanceWindow struct {
+	Name                string
+	Websites            []string
+	Labels              map[string]string
+	Start               string
+	End                 string
+	Schedule            string
+	Duration            Duration
+	ExcludeAvailability bool
+	Comment             string
+}
+
+//timestampLayouts are the layouts accepted for times of maintenance windows, the ones without zone being in local time.
+var timestampLayouts = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02 15:04:05"}
+
+//parseTimestamp parses a time of a maintenance window.
+func parseTimestamp(s string) (time.Time, error) {
+	for _, layout := range timestampLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a valid time, e.g. \"2026-10-20 22:00\"", s)
+}
+
+//maintenance is a MaintenanceWindow ready to be checked. Recurring windows remember their last occurrence,
+//and until when they are known to be inactive, so that schedules are searched at most once a minute.
+type maintenance struct {
+	MaintenanceWindow
+	start, end    time.Time
+	cron          *cronSchedule
+	lastStart     time.Time
+	inactiveUntil time.Time
+	mux           sync.Mutex
+}
+
+//compile checks a MaintenanceWindow and prepares it to be checked.
+func (w MaintenanceWindow) compile() (*maintenance, error) {
+	m := &maintenance{MaintenanceWindow: w}
+	var err error
+	switch {
+	case w.Schedule != "" && (w.Start != "" || w.End != ""):
+		return nil, fmt.Errorf("a window is either one-off, with a start and an end, or recurring, with a schedule")
+	case w.Schedule != "":
+		if m.cron, err = parseCron(w.Schedule); err != nil {
+			return nil, err
+		}
+		if w.Duration <= 0 {
+			return nil, fmt.Errorf("a recurring window needs a positive duration")
+		}
+		if w.Duration > Duration(7*24*time.Hour) {
+			return nil, fmt.Errorf("a recurring window cannot last more than a week")
+		}
+	default:
+		if m.start, err = parseTimestamp(w.Start); err != nil {
+			return nil, err
+		}
+		if m.end, err = parseTimestamp(w.End); err != nil {
+			return nil, err
+		}
+		if !m.end.After(m.start) {
+			return nil, fmt.Errorf("a window must end after its start")
+		}
+	}
+	return m, nil
+}
+
+//applies tells whether the window selects a website.
+func (m *maintenance) applies(name string, labels map[string]string) bool {
+	return (len(m.Websites) == 0 || contains(m.Websites, name)) && hasLabels(labels, m.Labels)
+}
+
+//active tells whether the window is in progress at a given time.
+func (m *maintenance) active(t time.Time) bool {
+	if m.cron == nil {
+		return !t.Before(m.start) && t.Before(m.end)
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	d := time.Duration(m.Duration)
+	if !m.lastStart.IsZero() && !t.Before(m.lastStart) && t.Before(m.lastStart.Add(d)) {
+		return true
+	}
+	if t.Before(m.inactiveUntil) {
+		return false
+	}
+	//Search the latest occurrence which may still be in progress
+	for s := t.Truncate(time.Minute); t.Sub(s) < d; s = s.Add(-time.Minute) {
+		if m.cron.match(s) {
+			m.lastStart = s
+			return true
+		}
+	}
+	m.inactiveUntil = t.Truncate(time.Minute).Add(time.Minute)
+	return false
+}
+
+//getMaintenances returns the maintenance windows of the configuration, ready to be checked. Invalid windows are ignored with a warning.
+func getMaintenances(conf Config) []*maintenance {
+	windows := make([]*maintenance, 0, len(conf.Maintenance))
+	for i, w := range conf.Maintenance {
+		m, err := w.compile()
+		if err != nil {
+			log.Printf("Warning : maintenance window %s ignored : %v", w.Name, err)
+			continue
+		}
+		if m.Name == "" {
+			m.Name = "maintenance " + strconv.Itoa(i)
+		}
+		windows = append(windows, m)
+	}
+	return windows
+}
+
+//inMaintenance returns the first window in progress for a website at a given time, or nil.
+func inMaintenance(windows []*maintenance, name string, labels map[string]string, t time.Time) *maintenance {
+	for _, m := range windows {
+		if m.applies(name, labels) && m.active(t) {
+			return m
+		}
+	}
+	return nil
+}
+
+//markMaintenance marks a MetaResponse checked during a maintenance window.
+func markMaintenance(windows []*maintenance, data *MetaResponse) {
+	if m := inMaintenance(windows, data.Name, data.Labels, data.Timestamp); m != nil {
+		data.Maintenance = m.Name
+		data.ExcludedFromAvailability = m.ExcludeAvailability
+	}
+}
+
+//cronSchedule is a parsed cron-style schedule : the allowed values of each field.
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	//Whether day-of-month and day-of-week are restricted, as days match either of them when both are
+	domAny, dowAny bool
+}
+
+//cronFields are the bounds of the fields of a cron-style schedule.
+var cronFields = []struct {
+	name     string
+	min, max int
+}{{"minute", 0, 59}, {"hour", 0, 23}, {"day of month", 1, 31}, {"month", 1, 12}, {"day of week", 0, 7}}
+
+//parseCron parses a cron-style schedule. Fields are "*", values, ranges ("1-5") or lists of them ("1,3"),
+//optionally with a step ("*/15"). Sunday is either 0 or 7.
+func parseCron(s string) (*cronSchedule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("%q is not a valid schedule, e.g. \"0 3 * * 0\"", s)
+	}
+	sets := make([]map[int]bool, len(fields))
+	for i, f := range fields {
+		set, err := parseCronField(f, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("%s of %q : %v", cronFields[i].name, s, err)
+		}
+		sets[i] = set
+	}
+	if sets[4][7] {
+		sets[4][0] = true
+	}
+	return &cronSchedule{sets[0], sets[1], sets[2], sets[3], sets[4], fields[2] == "*", fields[4] == "*"}, nil
+}
+
+//parseCronField parses a field of a cron-style schedule into the set of its values.
+func parseCronField(f string, min int, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(f, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return nil, fmt.Errorf("%q is not a valid step", part[i+1:])
+			}
+			part = part[:i]
+		}
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("%q is not a valid value", part)
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("%q is not a valid range", part)
+				}
+			}
+		}
+		if low < min || high > max || low > high {
+			return nil, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := low; v <= high; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+//match tells whether a time matches the schedule, to the minute.
+func (c *cronSchedule) match(t time.Time) bool {
+	if !c.minute[t.Minute()] || !c.hour[t.Hour()] || !c.month[int(t.Month())] {
+		return false
+	}
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+//Silence suppresses notifications of alerts from Start to End, e.g. while investigating an incident. It selects alerts
+//of websites by name, by labels and by rule ("availability" for availability alerts) : all alerts are selected if none is given.
+type Silence struct {
+	ID       string
+	Websites []string
+	Labels   map[string]string
+	Rules    []string
+	Start    time.Time
+	End      time.Time
+	Comment  string
+}
+
+//matches tells whether the silence is in progress at a given time for an alert.
+func (s Silence) matches(a Alert, t time.Time) bool {
+	return !t.Before(s.Start) && t.Before(s.End) && (len(s.Websites) == 0 || contains(s.Websites, a.Website)) &&
+		hasLabels(a.Labels, s.Labels) && (len(s.Rules) == 0 || contains(s.Rules, a.Rule))
+}
+
+func (s Silence) String() string {
+	target := make([]string, 0)
+	if len(s.Websites) > 0 {
+		target = append(target, "websites "+strings.Join(s.Websites, ", "))
+	}
+	if len(s.Labels) > 0 {
+		target = append(target, "labels "+formatLabels(s.Labels))
+	}
+	if len(s.Rules) > 0 {
+		target = append(target, "rules "+strings.Join(s.Rules, ", "))
+	}
+	if len(target) == 0 {
+		target = append(target, "all alerts")
+	}
+	return fmt.Sprintf("%s : %s, until %v (%s)", s.ID, strings.Join(target, " ; "), s.End.Format("2006/01/02 15:04:05"), s.Comment)
+}
+
+//silencesFile is the name of the file silences are persisted to, in the storage directory.
+const silencesFile = "silences.json"
+
+//Silences holds silences, persisted to a file if it has a path : silences added by other processes, e.g. by the
+//micromon silence command, are loaded as soon as the file changes. Expired silences are dropped. It is safe for concurrent use.
+type Silences struct {
+	path     string
+	silences []Silence
+	modTime  time.Time
+	mux      sync.Mutex
+}
+
+//silencesPath returns the path of the file silences are persisted to, or "" if they are kept in memory.
+func silencesPath(conf Config) string {
+	if conf.SilencesPath != "" {
+		return conf.SilencesPath
+	}
+	if conf.Storage.Type == "file" {
+		return filepath.Join(conf.Storage.Path, silencesFile)
+	}
+	return ""
+}
+
+//OpenSilences opens the silences of the configuration. It returns a non-nil error if persisted silences cannot be read.
+func OpenSilences(conf Config) (*Silences, error) {
+	s := &Silences{path: silencesPath(conf)}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s, s.load()
+}
+
+//Persistent tells whether silences are persisted to a file.
+func (s *Silences) Persistent() bool {
+	return s.path != ""
+}
+
+//load reloads silences if their file changed. The caller must hold the lock.
+func (s *Silences) load() error {
+	if s.path == "" {
+		return nil
+	}
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	silences := make([]Silence, 0)
+	if err := json.Unmarshal(data, &silences); err != nil {
+		return fmt.Errorf("cannot read silences from %s : %v", s.path, err)
+	}
+	s.silences, s.modTime = silences, info.ModTime()
+	return nil
+}
+
+//save drops expired silences and persists the others, if silences have a path. The caller must hold the lock.
+func (s *Silences) save(now time.Time) error {
+	kept := s.silences[:0]
+	for _, silence := range s.silences {
+		if now.Before(silence.End) {
+			kept = append(kept, silence)
+		}
+	}
+	s.silences = kept
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.silences)
+	if err != nil {
+		return err
+	}
+	if err := writeAtomic(s.path, data); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+//Add adds a silence, giving it an ID and starting it now if it has no start. It returns the silence added.
+//It returns a non-nil error if the silence does not end in the future or cannot be persisted.
+func (s *Silences) Add(silence Silence) (Silence, error) {
+	now := time.Now()
+	if silence.Start.IsZero() {
+		silence.Start = now
+	}
+	if !silence.End.After(now) || !silence.End.After(silence.Start) {
+		return silence, fmt.Errorf("a silence must end in the future, after its start")
+	}
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return silence, err
+	}
+	silence.ID = hex.EncodeToString(id)
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if err := s.load(); err != nil {
+		return silence, err
+	}
+	s.silences = append(s.silences, silence)
+	return silence, s.save(now)
+}
+
+//Expire ends a silence now. It returns a non-nil error if no silence has the given ID, or if it cannot be persisted.
+func (s *Silences) Expire(id string) error {
+	now := time.Now()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	for i := range s.silences {
+		if s.silences[i].ID == id && now.Before(s.silences[i].End) {
+			s.silences[i].End = now
+			return s.save(now)
+		}
+	}
+	return fmt.Errorf("no silence has ID %s", id)
+}
+
+//List returns the silences which have not expired, ordered by end.
+func (s *Silences) List() []Silence {
+	now := time.Now()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if err := s.load(); err != nil {
+		log.Printf("Warning : cannot load silences : %v", err)
+	}
+	res := make([]Silence, 0)
+	for _, silence := range s.silences {
+		if now.Before(silence.End) {
+			res = append(res, silence)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].End.Before(res[j].End) })
+	return res
+}
+
+//match returns the first silence in progress for an alert, if any.
+func (s *Silences) match(a Alert, t time.Time) (Silence, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if err := s.load(); err != nil {
+		log.Printf("Warning : cannot load silences : %v", err)
+	}
+	for _, silence := range s.silences {
+		if silence.matches(a, t) {
+			return silence, true
+		}
+	}
+	return Silence{}, false
+}
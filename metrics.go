@@ -2,7 +2,9 @@ package micromon
 
 import (
 	"fmt"
+	"math"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -16,6 +18,7 @@ type Result interface {
 //Metric defines how a metric should behave.
 type Metric interface {
 	//Compute takes a slice of MetaResponse and produce a single aggregated Result.
+	//It returns nil if the Metric does not apply to these MetaResponse.
 	Compute([]MetaResponse) Result
 
 	//Description returns a string describing what does the Metric.
@@ -26,9 +29,25 @@ type Metric interface {
 }
 
 //GetMetric allows to instantiate a Metric from a string and return it.
-//If no corresponding Metric is found, a non-nil error is returned.
+//Parameterized metrics take their parameter after a colon, e.g. "percentile:95".
+//If no corresponding Metric is found, or if parameter is invalid, a non-nil error is returned.
 func GetMetric(name string) (Metric, error) {
+	name, param := splitMetricName(name)
 	switch name {
+	case "percentile":
+		return NewPercentile(param)
+	case "p50", "p90", "p95", "p99":
+		return NewPercentile(name[1:])
+	case "latencyHistogram":
+		return NewLatencyHistogram(param)
+	case "averageDNSTime":
+		return AvgPhaseTime{"dns"}, nil
+	case "averageConnectTime":
+		return AvgPhaseTime{"connect"}, nil
+	case "averageTLSTime":
+		return AvgPhaseTime{"tls"}, nil
+	case "averageTransferTime":
+		return AvgPhaseTime{"transfer"}, nil
 	case "averageTime":
 		return AvgRespTime{}, nil
 	case "maxTime":
@@ -37,11 +56,24 @@ func GetMetric(name string) (Metric, error) {
 		return CodeCount{}, nil
 	case "availability":
 		return Availability{}, nil
+	case "failureReasons":
+		return FailureReasons{}, nil
+	case "certDaysRemaining":
+		return CertDaysRemaining{}, nil
 	}
 	return nil, fmt.Errorf("%s is not a known metric name", name)
 }
 
+//splitMetricName splits a metric name from its parameter, if any.
+func splitMetricName(name string) (string, string) {
+	if i := strings.Index(name, ":"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, ""
+}
+
 //AvgRespTime implements Metric and compute the average response time.
+//As other response time metrics, it ignores unavailable checks, which response time is meaningless.
 type AvgRespTime struct{}
 
 //MaxRespTime implements Metric and compute the maximum response time.
@@ -53,12 +85,40 @@ type CodeCount struct{}
 //Availability implements Metric and compute the percentage of availability.
 type Availability struct{}
 
+//AvgPhaseTime implements Metric and compute the average duration of a request phase : "dns", "connect", "tls" or "transfer".
+//Responses in which the phase did not happen, e.g. TLS handshake for plain HTTP, are not taken into account.
+type AvgPhaseTime struct {
+	Phase string
+}
+
+//Percentile implements Metric and compute a percentile of response times, e.g. 95 for the 95th percentile.
+//It relies on a Sketch, so that it can also be computed from rollups.
+type Percentile struct {
+	P float64
+}
+
+//NewPercentile builds a Percentile from a string parameter, which must be a number in ]0, 100].
+func NewPercentile(param string) (Percentile, error) {
+	p, err := strconv.ParseFloat(param, 64)
+	if err != nil || p <= 0 || p > 100 {
+		return Percentile{}, fmt.Errorf("%q is not a valid percentile", param)
+	}
+	return Percentile{p}, nil
+}
+
 func (AvgRespTime) Compute(data []MetaResponse) Result {
 	sum := float64(0)
+	count := 0
 	for _, m := range data {
-		sum += float64(m.RespDuration) / float64(time.Millisecond)
+		if m.Available {
+			sum += float64(m.RespDuration) / float64(time.Millisecond)
+			count++
+		}
+	}
+	if count == 0 {
+		return MetricFloat(0)
 	}
-	return MetricFloat(sum / float64(len(data)))
+	return MetricFloat(sum / float64(count))
 }
 
 func (AvgRespTime) Description() string {
@@ -72,7 +132,7 @@ func (AvgRespTime) Name() string {
 func (MaxRespTime) Compute(data []MetaResponse) Result {
 	max := time.Duration(0)
 	for _, m := range data {
-		if m.RespDuration > max {
+		if m.Available && m.RespDuration > max {
 			max = m.RespDuration
 		}
 	}
@@ -107,14 +167,22 @@ func (CodeCount) Name() string {
 	return "codeCount"
 }
 
+//Compute ignores responses excluded from availability by maintenance windows, and returns nil if there are only such responses.
 func (Availability) Compute(data []MetaResponse) Result {
-	count := 0
+	count, total := 0, 0
 	for _, m := range data {
+		if m.ExcludedFromAvailability {
+			continue
+		}
+		total++
 		if m.Available {
 			count++
 		}
 	}
-	return MetricFloat(float64(count) / float64(len(data)) * 100)
+	if total == 0 {
+		return nil
+	}
+	return MetricFloat(float64(count) / float64(total) * 100)
 }
 
 func (Availability) Description() string {
@@ -125,6 +193,101 @@ func (Availability) Name() string {
 	return "availability"
 }
 
+func (a AvgPhaseTime) Compute(data []MetaResponse) Result {
+	sum := float64(0)
+	count := 0
+	for _, m := range data {
+		if d := a.duration(m); d > 0 {
+			sum += float64(d) / float64(time.Millisecond)
+			count++
+		}
+	}
+	if count == 0 {
+		return MetricFloat(0)
+	}
+	return MetricFloat(sum / float64(count))
+}
+
+//duration returns the duration of the phase in a MetaResponse.
+func (a AvgPhaseTime) duration(m MetaResponse) time.Duration {
+	switch a.Phase {
+	case "dns":
+		return m.DNSDuration
+	case "connect":
+		return m.ConnectDuration
+	case "tls":
+		return m.TLSDuration
+	case "transfer":
+		return m.TransferDuration
+	}
+	return 0
+}
+
+func (a AvgPhaseTime) Description() string {
+	switch a.Phase {
+	case "dns":
+		return "Average DNS lookup time (ms)"
+	case "connect":
+		return "Average connection time (ms)"
+	case "tls":
+		return "Average TLS handshake time (ms)"
+	}
+	return "Average transfer time (ms)"
+}
+
+func (a AvgPhaseTime) Name() string {
+	switch a.Phase {
+	case "dns":
+		return "averageDNSTime"
+	case "connect":
+		return "averageConnectTime"
+	case "tls":
+		return "averageTLSTime"
+	}
+	return "averageTransferTime"
+}
+
+func (p Percentile) Compute(data []MetaResponse) Result {
+	s := Sketch{}
+	for _, m := range data {
+		if m.Available {
+			s.Add(m.RespDuration)
+		}
+	}
+	return p.ComputeRollup(Rollup{Latency: s})
+}
+
+func (p Percentile) ComputeRollup(r Rollup) Result {
+	return MetricFloat(float64(r.Latency.Quantile(p.P/100)) / float64(time.Millisecond))
+}
+
+func (p Percentile) Description() string {
+	return fmt.Sprintf("%v percentile response time (ms)", ordinal(p.P))
+}
+
+func (p Percentile) Name() string {
+	return "percentile:" + strconv.FormatFloat(p.P, 'f', -1, 64)
+}
+
+//ordinal formats a number as an english ordinal, e.g. 1st, 2nd, 95th or 99.9th.
+func ordinal(n float64) string {
+	s := strconv.FormatFloat(n, 'f', -1, 64)
+	if n != math.Trunc(n) {
+		return s + "th"
+	}
+	switch i := int(n); {
+	case i%100 >= 11 && i%100 <= 13:
+		return s + "th"
+	case i%10 == 1:
+		return s + "st"
+	case i%10 == 2:
+		return s + "nd"
+	case i%10 == 3:
+		return s + "rd"
+	}
+	return s + "th"
+}
+
 //MetricInt implements Result and represents an integer result.
 type MetricInt int
 
@@ -0,0 +1,343 @@
+package micromon
+
+import (
+	"context"
+	"errors"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+//Monitor implements the complete monitoring logic for a configuration : websites are watched, responses are stored,
+//and metrics are computed, hooked and reported for each timeframe. It is meant to be embedded in other programs :
+//Run blocks until the monitor is stopped, either with its context or with Stop, and all goroutines are drained before it returns.
+//While running, the configuration can be replaced with Reload without losing history.
+type Monitor struct {
+	conf      Config
+	retention Retention
+	datas     respMap
+	store     Store
+	incidents *IncidentHistory
+	silences  *Silences
+	//Maintenance windows, to mark responses
+	maintenances []*maintenance
+	metrics      SiteMetrics
+	schedules    []Schedule
+	watchers     *watchers
+	//Schedules and rollups saving goroutines, stopped on reload
+	scheduling context.CancelFunc
+	schedWg    sync.WaitGroup
+	reloads    chan reload
+	done       chan struct{}
+	mux        sync.Mutex
+	cancel     context.CancelFunc
+	started    bool
+}
+
+//reload is a request for a running Monitor to replace its configuration.
+type reload struct {
+	conf Config
+	err  chan error
+}
+
+//NewMonitor builds a Monitor from a configuration. History is reloaded from the configured storage, and incidents from
+//the incident history. It returns a non-nil error if the storage, the incident history or a reporter cannot be opened.
+func NewMonitor(conf Config) (*Monitor, error) {
+	m := &Monitor{
+		conf:      conf,
+		retention: GetRetention(conf),
+		metrics:   GetSiteMetrics(conf),
+		reloads:   make(chan reload),
+		done:      make(chan struct{}),
+	}
+
+	//Create data structure for holding response data
+	m.datas = NewRespMap(len(conf.Websites))
+	for k := range conf.Websites {
+		m.datas[k] = NewBoundedSafeData(m.retention)
+	}
+
+	//Reload history from storage
+	var err error
+	if m.store, err = GetStore(conf.Storage, m.retention); err != nil {
+		return nil, err
+	}
+	if err := (&m.datas).Restore(m.store, m.retention); err != nil {
+		m.store.Close()
+		return nil, err
+	}
+
+	//Configure schedules of each timeframe, resuming ongoing incidents
+	if m.incidents, err = OpenIncidentHistory(conf); err != nil {
+		m.store.Close()
+		return nil, err
+	}
+	if m.silences, err = OpenSilences(conf); err != nil {
+		m.store.Close()
+		return nil, err
+	}
+	if m.schedules, err = getSchedules(conf, m.incidents, m.silences); err != nil {
+		m.store.Close()
+		return nil, err
+	}
+	m.incidents.resolve(activeIncidents(conf), time.Now())
+	m.maintenances = getMaintenances(conf)
+	return m, nil
+}
+
+//Run starts monitoring and blocks until the context is cancelled or Stop is called.
+//On shutdown, in-flight checks are cancelled, metrics of each timeframe are reported a last time,
+//and storage and reporters are closed. A Monitor can only be run once.
+func (m *Monitor) Run(ctx context.Context) error {
+	m.mux.Lock()
+	if m.started {
+		m.mux.Unlock()
+		return errors.New("monitor has already been run")
+	}
+	ctx, m.cancel = context.WithCancel(ctx)
+	m.started = true
+	m.mux.Unlock()
+	defer m.cancel()
+	defer close(m.done)
+
+	//Watch websites, sending response data to the channel
+	m.watchers = newWatchers(ctx, m.conf)
+	if err := m.watchers.startHeartbeats(m.conf); err != nil {
+		m.close()
+		return err
+	}
+	for name, website := range m.conf.Websites {
+		m.watchers.start(name, website)
+	}
+
+	//Compute metrics of each timeframe and save rollups in background
+	m.startSchedules(ctx)
+
+	//Listen to data coming from channel and to reloads : sequential access to datas variable
+loop:
+	for {
+		select {
+		case data := <-m.watchers.ch:
+			m.add(data)
+		case r := <-m.reloads:
+			r.err <- m.reload(ctx, r.conf)
+		case <-ctx.Done():
+			break loop
+		}
+	}
+
+	//Drain watchers
+	m.stopSchedules()
+	go m.watchers.close()
+	for data := range m.watchers.ch {
+		m.add(data)
+	}
+
+	//Final report
+	for _, s := range m.schedules {
+		s.report(&m.datas, m.metrics)
+	}
+	if m.retention.Rollups {
+		if err := m.store.SaveRollups((&m.datas).Rollups()); err != nil {
+			log.Printf("Warning : cannot store rollups : %v", err)
+		}
+	}
+	return m.close()
+}
+
+//Incidents returns the incidents of the history selected by a query, from the oldest to the newest.
+func (m *Monitor) Incidents(q IncidentQuery) []Incident {
+	return m.incidents.Query(q)
+}
+
+//Silence adds a silence, which suppresses notifications of the alerts it selects until it ends.
+//It returns the silence added, with its ID, or a non-nil error if it is invalid or cannot be persisted.
+func (m *Monitor) Silence(s Silence) (Silence, error) {
+	return m.silences.Add(s)
+}
+
+//Expire ends the silence which ID is given in parameter.
+func (m *Monitor) Expire(id string) error {
+	return m.silences.Expire(id)
+}
+
+//Silences returns the silences which have not expired yet.
+func (m *Monitor) Silences() []Silence {
+	return m.silences.List()
+}
+
+//Stop asks a running Monitor to stop. Run returns once shutdown is complete.
+func (m *Monitor) Stop() {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.cancel != nil {
+		m.cancel()
+	}
+}
+
+//Reload replaces the configuration of a running Monitor. Only the websites which configuration changed are restarted,
+//and history of websites which are still checked the same way is kept. Metrics, hooks and reporters are rebuilt :
+//websites which are down are resumed from their ongoing incidents, while hysteresis streaks, flap detection and
+//pending rules start over. Notifications pending with the previous notifiers are delivered in background.
+//If the new configuration cannot be applied, a non-nil error is returned and the current one keeps running.
+//Retention, storage, incident history and silences changes are only applied on restart.
+func (m *Monitor) Reload(conf Config) error {
+	m.mux.Lock()
+	started := m.started
+	m.mux.Unlock()
+	if !started {
+		return errors.New("monitor is not running")
+	}
+	r := reload{conf, make(chan error, 1)}
+	select {
+	case m.reloads <- r:
+		return <-r.err
+	case <-m.done:
+		return errors.New("monitor is stopped")
+	}
+}
+
+//ReloadFile fetches the configuration file which path is given in parameter and reloads the Monitor with it, see Reload.
+func (m *Monitor) ReloadFile(path string) error {
+	conf, err := FetchConfig(path)
+	if err != nil {
+		return err
+	}
+	return m.Reload(conf)
+}
+
+//reload applies a new configuration. It must be called from the Run goroutine.
+func (m *Monitor) reload(ctx context.Context, conf Config) error {
+	//Build everything which may fail first, to keep the current configuration on error
+	if conf.Incidents != m.conf.Incidents || incidentsPath(conf) != incidentsPath(m.conf) || silencesPath(conf) != silencesPath(m.conf) {
+		log.Printf("Warning : incident history and silences changes are ignored until restart")
+		conf.Incidents, conf.SilencesPath = m.conf.Incidents, m.conf.SilencesPath
+	}
+	schedules, err := getSchedules(conf, m.incidents, m.silences)
+	if err != nil {
+		return err
+	}
+	if conf.PushListen != m.conf.PushListen || !reflect.DeepEqual(pushWebsites(conf), pushWebsites(m.conf)) {
+		if err := m.watchers.startHeartbeats(conf); err != nil {
+			closeSchedules(schedules, false)
+			//Get the previous push endpoint back
+			if err := m.watchers.startHeartbeats(m.conf); err != nil {
+				log.Printf("Warning : cannot restore push endpoint : %v", err)
+			}
+			return err
+		}
+	}
+	if conf.Retention != m.conf.Retention || conf.Storage != m.conf.Storage {
+		log.Printf("Warning : retention and storage changes are ignored until restart")
+		conf.Retention, conf.Storage = m.conf.Retention, m.conf.Storage
+	}
+
+	//Stop what depends on the set of websites, without waiting for pending notifications so that responses keep being consumed
+	m.stopSchedules()
+	closeSchedules(m.schedules, false)
+
+	//Restart changed websites, keeping history if they are still checked the same way
+	restartAll := conf.Timeout != m.conf.Timeout
+	m.watchers.timeout = time.Duration(conf.Timeout)
+	for name, old := range m.conf.Websites {
+		website, ok := conf.Websites[name]
+		if !ok || restartAll || !reflect.DeepEqual(old, website) {
+			m.watchers.stop(name)
+		}
+		if !ok || old.URL != website.URL || old.Type != website.Type {
+			delete(m.datas, name)
+		}
+	}
+	for name, website := range conf.Websites {
+		old, ok := m.conf.Websites[name]
+		if !ok || restartAll || !reflect.DeepEqual(old, website) {
+			m.watchers.start(name, website)
+		}
+		if _, ok := m.datas[name]; !ok {
+			m.datas[name] = NewBoundedSafeData(m.retention)
+		}
+	}
+
+	m.conf, m.schedules, m.metrics = conf, schedules, GetSiteMetrics(conf)
+	//Incidents which cannot be ended anymore are ended once the configuration is applied
+	m.incidents.resolve(activeIncidents(conf), time.Now())
+	m.maintenances = getMaintenances(conf)
+	m.startSchedules(ctx)
+	log.Printf("Configuration reloaded : %d websites", len(conf.Websites))
+	return nil
+}
+
+//add records a MetaResponse. Responses of websites removed by a reload are dropped.
+func (m *Monitor) add(data MetaResponse) {
+	d, ok := m.datas[data.Name]
+	if !ok {
+		return
+	}
+	markMaintenance(m.maintenances, &data)
+	d.Add(data)
+	if err := m.store.Append(data); err != nil {
+		log.Printf("Warning : cannot store response : %v", err)
+	}
+}
+
+//startSchedules starts computing metrics of each timeframe and saving rollups, until stopSchedules is called.
+func (m *Monitor) startSchedules(ctx context.Context) {
+	ctx, m.scheduling = context.WithCancel(ctx)
+	for _, s := range m.schedules {
+		m.schedWg.Add(1)
+		go func(s Schedule) {
+			defer m.schedWg.Done()
+			s.Run(ctx, &m.datas, m.metrics)
+		}(s)
+	}
+	if m.retention.Rollups {
+		m.schedWg.Add(1)
+		go func() {
+			defer m.schedWg.Done()
+			m.saveRollups(ctx)
+		}()
+	}
+}
+
+//stopSchedules stops schedules and rollups saving, and waits for them so that datas can be modified.
+func (m *Monitor) stopSchedules() {
+	m.scheduling()
+	m.schedWg.Wait()
+}
+
+//saveRollups saves rollups every minute so that long-range history survives restarts, until the context is cancelled.
+func (m *Monitor) saveRollups(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.store.SaveRollups((&m.datas).Rollups()); err != nil {
+				log.Printf("Warning : cannot store rollups : %v", err)
+			}
+		}
+	}
+}
+
+//close releases storage, reporters and notifiers, returning the first error met.
+func (m *Monitor) close() error {
+	err := m.store.Close()
+	if e := closeSchedules(m.schedules, true); err == nil {
+		err = e
+	}
+	return err
+}
+
+//pushWebsites returns the push websites of a configuration.
+func pushWebsites(conf Config) map[string]Website {
+	sites := make(map[string]Website)
+	for name, website := range conf.Websites {
+		if website.Type == "push" {
+			sites[name] = website
+		}
+	}
+	return sites
+}
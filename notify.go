@@ -0,0 +1,448 @@
+package micromon
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+//NotifierConf describes an alert notification channel of the configuration. Type is "webhook", "smtp" or "exec".
+//Webhooks POST the Alert as JSON to URL, or Template rendered with the Alert (see text/template) if set, along with Headers.
+//Failed deliveries are retried Retries times (3 by default), waiting Backoff (1 second by default) and doubling it each time.
+//SMTP notifiers send an email From an address To others through the server at Address ("host:port"), authenticated
+//with Username and Password if set. Exec notifiers run Command with Args : alert data is given in MICROMON_* environment
+//variables and as JSON on the standard input. Timeout bounds each delivery, 10 seconds by default.
+//Password and Headers values may be secrets, e.g. "env:SMTP_PASSWORD".
+type NotifierConf struct {
+	Type     string
+	URL      string
+	Template string
+	Headers  map[string]string
+	Retries  *int
+	Backoff  Duration
+	Address  string
+	From     string
+	To       []string
+	Username string
+	Password string
+	Command  string
+	Args     []string
+	Timeout  Duration
+}
+
+//Default delivery settings of notifiers.
+const (
+	defaultNotifyRetries = 3
+	defaultNotifyBackoff = Duration(time.Second)
+	defaultNotifyTimeout = Duration(10 * time.Second)
+	notifyQueueSize      = 100
+	notifyDrainTimeout   = 5 * time.Second
+)
+
+//Notifier delivers alerts to people or systems.
+type Notifier interface {
+	//Notify delivers an Alert, returning a non-nil error if it could not be delivered.
+	Notify(ctx context.Context, a Alert) error
+}
+
+//GetNotifier builds the Notifier described by a NotifierConf, resolving its secrets.
+//If the NotifierConf is invalid or a secret cannot be resolved, a non-nil error is returned.
+func GetNotifier(conf NotifierConf) (Notifier, error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	var err error
+	if conf, err = conf.resolveSecrets(); err != nil {
+		return nil, err
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = defaultNotifyTimeout
+	}
+
+	switch conf.Type {
+	case "webhook":
+		n := &WebhookNotifier{conf: conf, client: &http.Client{Timeout: time.Duration(conf.Timeout)}}
+		if conf.Template != "" {
+			n.template = template.Must(template.New("webhook").Parse(conf.Template))
+		}
+		return n, nil
+	case "smtp":
+		return SMTPNotifier{conf}, nil
+	case "exec":
+		return ExecNotifier{conf}, nil
+	}
+	return nil, fmt.Errorf("%s is not a known notifier type", conf.Type)
+}
+
+//validate checks a NotifierConf without resolving its secrets : only the syntax of secret references is checked.
+func (conf NotifierConf) validate() error {
+	if err := checkSecret(conf.Password); err != nil {
+		return err
+	}
+	for _, v := range conf.Headers {
+		if err := checkSecret(v); err != nil {
+			return err
+		}
+	}
+	switch conf.Type {
+	case "webhook":
+		if conf.URL == "" {
+			return fmt.Errorf("a webhook needs an url")
+		}
+		if conf.Template != "" {
+			if _, err := template.New("webhook").Parse(conf.Template); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "smtp":
+		if _, _, err := net.SplitHostPort(conf.Address); err != nil {
+			return err
+		}
+		if conf.From == "" || len(conf.To) == 0 {
+			return fmt.Errorf("an email needs a sender and recipients")
+		}
+		return nil
+	case "exec":
+		if conf.Command == "" {
+			return fmt.Errorf("a command is needed")
+		}
+		return nil
+	}
+	return fmt.Errorf("%s is not a known notifier type", conf.Type)
+}
+
+//resolveSecrets returns a copy of a NotifierConf in which references in the password and headers are resolved.
+func (conf NotifierConf) resolveSecrets() (NotifierConf, error) {
+	var err error
+	if conf.Password, err = resolveSecret(conf.Password); err != nil {
+		return conf, err
+	}
+	headers := make(map[string]string, len(conf.Headers))
+	for k, v := range conf.Headers {
+		if headers[k], err = resolveSecret(v); err != nil {
+			return conf, err
+		}
+	}
+	conf.Headers = headers
+	return conf, nil
+}
+
+//WebhookNotifier implements Notifier and posts alerts to an HTTP endpoint, retrying with an exponential backoff.
+type WebhookNotifier struct {
+	conf     NotifierConf
+	client   *http.Client
+	template *template.Template
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, a Alert) error {
+	var body bytes.Buffer
+	if n.template != nil {
+		if err := n.template.Execute(&body, a); err != nil {
+			return err
+		}
+	} else if err := json.NewEncoder(&body).Encode(a); err != nil {
+		return err
+	}
+
+	retries, backoff := defaultNotifyRetries, time.Duration(n.conf.Backoff)
+	if n.conf.Retries != nil {
+		retries = *n.conf.Retries
+	}
+	if backoff == 0 {
+		backoff = time.Duration(defaultNotifyBackoff)
+	}
+	var err error
+	for i := 0; ; i++ {
+		if err = n.post(ctx, body.Bytes()); err == nil || i == retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff << uint(i)):
+		}
+	}
+}
+
+//post sends a single request to the webhook. Responses other than 2xx are errors.
+//The payload is sent as JSON unless Headers set another Content-Type.
+func (n *WebhookNotifier) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", n.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "MicroMon")
+	for k, v := range n.conf.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+//SMTPNotifier implements Notifier and sends alerts by email.
+type SMTPNotifier struct {
+	conf NotifierConf
+}
+
+func (n SMTPNotifier) Notify(ctx context.Context, a Alert) error {
+	//Names come from the configuration and must not be able to add headers
+	subject := headerSafe(fmt.Sprintf("[MicroMon] [%s] %s on %s is %s", a.Severity, a.Rule, a.Website, a.State))
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%v\r\n",
+		n.conf.From, strings.Join(n.conf.To, ", "), subject, a.At.Format(time.RFC1123Z), a)
+	for _, k := range sortedKeys(a.Labels) {
+		msg += fmt.Sprintf("%s = %s\r\n", k, a.Labels[k])
+	}
+
+	var auth smtp.Auth
+	if n.conf.Username != "" {
+		host, _, _ := net.SplitHostPort(n.conf.Address)
+		auth = smtp.PlainAuth("", n.conf.Username, n.conf.Password, host)
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(n.conf.Timeout))
+	defer cancel()
+	return sendMail(ctx, n.conf.Address, auth, n.conf.From, n.conf.To, []byte(msg))
+}
+
+//headerSafe replaces line breaks of a header value with spaces.
+func headerSafe(v string) string {
+	return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(v)
+}
+
+//sendMail is like smtp.SendMail, but the connection is closed once the context is done, so that delivery stops.
+func sendMail(ctx context.Context, addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err := c.Auth(auth); err != nil {
+				return err
+			}
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+//ExecNotifier implements Notifier and runs a local command for each alert.
+type ExecNotifier struct {
+	conf NotifierConf
+}
+
+func (n ExecNotifier) Notify(ctx context.Context, a Alert) error {
+	payload, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(n.conf.Timeout))
+	defer cancel()
+	cmd := exec.CommandContext(ctx, n.conf.Command, n.conf.Args...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(), alertEnv(a)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v : %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+//alertEnv returns alert data as environment variables. Labels are given as MICROMON_LABEL_<NAME>.
+func alertEnv(a Alert) []string {
+	env := []string{
+		"MICROMON_RULE=" + a.Rule,
+		"MICROMON_SEVERITY=" + a.Severity,
+		"MICROMON_WEBSITE=" + a.Website,
+		"MICROMON_STATE=" + a.State,
+		"MICROMON_VALUE=" + strconv.FormatFloat(a.Value, 'f', -1, 64),
+		"MICROMON_SINCE=" + a.Since.Format(time.RFC3339),
+		"MICROMON_AT=" + a.At.Format(time.RFC3339),
+	}
+	for _, k := range sortedKeys(a.Labels) {
+		env = append(env, "MICROMON_LABEL_"+strings.ToUpper(k)+"="+a.Labels[k])
+	}
+	return env
+}
+
+//notifiers fans alerts out to the notifiers of the configuration. Each notifier has its own queue and goroutine,
+//so that a slow or failing channel does not delay others and alerts are delivered in order.
+//Deliveries, retries included, are aborted when ctx is cancelled.
+type notifiers struct {
+	names  []string
+	byName map[string]Notifier
+	queues map[string]chan Alert
+	wg     sync.WaitGroup
+	once   sync.Once
+	mux    sync.Mutex
+	closed bool
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+//getNotifiers builds the notifiers of the configuration. Invalid notifiers are ignored with a warning.
+func getNotifiers(conf Config) *notifiers {
+	n := &notifiers{byName: make(map[string]Notifier), queues: make(map[string]chan Alert)}
+	for _, name := range sortedNotifierNames(conf.Notifiers) {
+		notifier, err := GetNotifier(conf.Notifiers[name])
+		if err != nil {
+			log.Printf("Warning : notifier %s ignored : %v", name, err)
+			continue
+		}
+		n.names = append(n.names, name)
+		n.byName[name] = notifier
+	}
+	return n
+}
+
+//sortedNotifierNames returns the names of notifiers in alphabetical order.
+func sortedNotifierNames(m map[string]NotifierConf) []string {
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//send queues an Alert for the given notifiers, or for all notifiers if none is given.
+//Alerts are dropped with a warning if a queue is full or once notifiers are closed.
+func (n *notifiers) send(a Alert, names []string) {
+	if len(names) == 0 {
+		names = n.names
+	}
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if n.closed {
+		return
+	}
+	for _, name := range names {
+		notifier, ok := n.byName[name]
+		if !ok {
+			continue
+		}
+		q, started := n.queues[name]
+		if !started {
+			if n.ctx == nil {
+				n.ctx, n.cancel = context.WithCancel(context.Background())
+			}
+			q = make(chan Alert, notifyQueueSize)
+			n.queues[name] = q
+			n.wg.Add(1)
+			go n.deliver(n.ctx, name, notifier, q)
+		}
+		select {
+		case q <- a:
+		default:
+			log.Printf("Warning : notifier %s is overloaded, alert %s on %s dropped", name, a.Rule, a.Website)
+		}
+	}
+}
+
+//deliver delivers alerts of a queue until it is closed. Alerts left once the context is cancelled are dropped.
+func (n *notifiers) deliver(ctx context.Context, name string, notifier Notifier, q chan Alert) {
+	defer n.wg.Done()
+	for a := range q {
+		if ctx.Err() != nil {
+			log.Printf("Warning : notifier %s stopped, alert %s on %s dropped", name, a.Rule, a.Website)
+			continue
+		}
+		if err := notifier.Notify(ctx, a); err != nil {
+			log.Printf("Warning : notifier %s failed to deliver alert %s on %s : %v", name, a.Rule, a.Website, err)
+		}
+	}
+}
+
+//close stops accepting alerts and waits for queued ones to be delivered, for at most notifyDrainTimeout :
+//pending deliveries are then aborted. It may be called several times.
+func (n *notifiers) close() {
+	n.once.Do(func() {
+		n.mux.Lock()
+		n.closed = true
+		for _, q := range n.queues {
+			close(q)
+		}
+		n.mux.Unlock()
+	})
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(notifyDrainTimeout):
+		log.Printf("Warning : alerts not delivered within %v are dropped", notifyDrainTimeout)
+	}
+	n.mux.Lock()
+	if n.cancel != nil {
+		n.cancel()
+	}
+	n.mux.Unlock()
+	<-done
+}
@@ -0,0 +1,168 @@
+package micromon
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+//Prober defines how a website is checked. Whatever the protocol, checking a website produces a MetaResponse,
+//so that metrics, hooks and reporters do not depend on the kind of website.
+type Prober interface {
+	//Probe checks a Website with a timeout and produces a MetaResponse. The check is aborted if the context is cancelled.
+	//A non-nil error is only returned if the Website cannot be probed at all, e.g. because it is misconfigured.
+	Probe(ctx context.Context, website Website, timeout time.Duration) (MetaResponse, error)
+}
+
+//GetProber allows to instantiate a Prober from a website type and return it. The default type is "http".
+//If no corresponding Prober is found, a non-nil error is returned.
+func GetProber(name string) (Prober, error) {
+	switch name {
+	case "", "http":
+		return HTTPProber{}, nil
+	case "tcp":
+		return TCPProber{}, nil
+	case "dns":
+		return DNSProber{}, nil
+	case "tls":
+		return TLSProber{}, nil
+	}
+	return nil, fmt.Errorf("%s is not a known website type", name)
+}
+
+//HTTPProber implements Prober and performs an HTTP(S) request, see CheckWebsite.
+type HTTPProber struct{}
+
+//TCPProber implements Prober and opens a TCP connection to a "host:port" URL.
+//Response time is the connection time.
+type TCPProber struct{}
+
+//DNSProber implements Prober and resolves the host name given as URL, with the system resolver or with
+//the resolver which address ("host:port") is given in the Website configuration. Response time is the lookup time.
+type DNSProber struct{}
+
+//TLSProber implements Prober and performs a TLS handshake with a "host:port" URL, without speaking HTTP.
+//Response time is the handshake time. Certificates are recorded as for HTTPS websites.
+type TLSProber struct{}
+
+func (HTTPProber) Probe(ctx context.Context, website Website, timeout time.Duration) (MetaResponse, error) {
+	return CheckWebsite(ctx, website, timeout)
+}
+
+func (TCPProber) Probe(ctx context.Context, website Website, timeout time.Duration) (MetaResponse, error) {
+	meta := MetaResponse{URL: website.URL}
+	addr, err := probeAddress(website.URL, "tcp")
+	if err != nil {
+		return meta, err
+	}
+	conn, err := dialMeasured(ctx, &meta, addr, timeout)
+	meta.Timestamp = time.Now()
+	if err != nil {
+		return failedProbe(meta, err), nil
+	}
+	conn.Close()
+	meta.RespDuration = meta.ConnectDuration
+	meta.Available = true
+	return meta, nil
+}
+
+func (DNSProber) Probe(ctx context.Context, website Website, timeout time.Duration) (MetaResponse, error) {
+	meta := MetaResponse{URL: website.URL}
+	host := strings.TrimPrefix(website.URL, "dns://")
+	resolver := net.DefaultResolver
+	if website.Resolver != "" {
+		//Send all queries to the configured resolver
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, website.Resolver)
+			},
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	_, err := resolver.LookupHost(ctx, host)
+	meta.Timestamp = time.Now()
+	meta.DNSDuration = meta.Timestamp.Sub(start)
+	meta.RespDuration = meta.DNSDuration
+	if err != nil {
+		return failedProbe(meta, err), nil
+	}
+	meta.Available = true
+	return meta, nil
+}
+
+func (TLSProber) Probe(ctx context.Context, website Website, timeout time.Duration) (MetaResponse, error) {
+	meta := MetaResponse{URL: website.URL}
+	addr, err := probeAddress(website.URL, "tls")
+	if err != nil {
+		return meta, err
+	}
+	tlsConf, err := tlsClientConfig(website.TLS, &meta)
+	if err != nil {
+		return meta, err
+	}
+	tlsConf.ServerName, _, _ = net.SplitHostPort(addr)
+
+	conn, err := dialMeasured(ctx, &meta, addr, timeout)
+	if err != nil {
+		meta.Timestamp = time.Now()
+		return failedProbe(meta, err), nil
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	start := time.Now()
+	err = tls.Client(conn, tlsConf).HandshakeContext(ctx)
+	meta.Timestamp = time.Now()
+	meta.TLSDuration = meta.Timestamp.Sub(start)
+	meta.RespDuration = meta.TLSDuration
+	if err != nil {
+		return failedProbe(meta, handshakeError{err}), nil
+	}
+	meta.Available = true
+	return meta, nil
+}
+
+//probeAddress returns the "host:port" address of a URL such as "tcp://host:port" or "host:port".
+func probeAddress(url string, scheme string) (string, error) {
+	addr := strings.TrimPrefix(url, scheme+"://")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", fmt.Errorf("%s is not a valid %s address : %v", url, scheme, err)
+	}
+	return addr, nil
+}
+
+//dialMeasured opens a TCP connection to an address, recording DNS and connection times in a MetaResponse.
+func dialMeasured(ctx context.Context, meta *MetaResponse, addr string, timeout time.Duration) (net.Conn, error) {
+	host, port, _ := net.SplitHostPort(addr)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	//Resolve host name apart to measure it, unless it is an IP address
+	if net.ParseIP(host) == nil {
+		start := time.Now()
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		meta.DNSDuration = time.Now().Sub(start)
+		if err != nil {
+			return nil, err
+		}
+		host = addrs[0]
+	}
+	start := time.Now()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	meta.ConnectDuration = time.Now().Sub(start)
+	return conn, err
+}
+
+//failedProbe marks a MetaResponse as unavailable because of an error.
+func failedProbe(meta MetaResponse, err error) MetaResponse {
+	meta.Available = false
+	meta.Failure = classifyError(err)
+	meta.Error = err.Error()
+	return meta
+}
@@ -3,8 +3,12 @@ package micromon
 import (
 	"encoding/xml"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 //Formatter defines how a metric formatter, i.e. a type which operates on Metric and associated Results, should behave.
@@ -23,29 +27,64 @@ type Formatter interface {
 //Reporter is the association of a Logger and a Formatter.
 //This type is meant to be generic, i.e. to allow formatting in any fashion and writing everywhere.
 type Reporter struct {
-	l *log.Logger
-	f Formatter
+	l   *log.Logger
+	f   Formatter
+	out io.Closer
 }
 
 //NewReported constructs a Reporter from a Logger and a Formatter.
 func NewReporter(l *log.Logger, f Formatter) Reporter {
-	return Reporter{l, f}
+	return Reporter{l: l, f: f}
+}
+
+//Close closes the output of the Reporter, if it has been opened by GetReporter.
+func (r Reporter) Close() error {
+	if r.out != nil {
+		return r.out.Close()
+	}
+	return nil
+}
+
+//getFormatter returns the Formatter of a format name : "xml", or the default one if the name is empty.
+func getFormatter(name string) (Formatter, error) {
+	switch name {
+	case "":
+		return DefaultFormatter{}, nil
+	case "xml":
+		return XMLFormatter{}, nil
+	}
+	return nil, fmt.Errorf("%s is not a known format", name)
 }
 
 //DefaultFormatter implements Formatter and is a provided classic formatter suited for console writing.
 type DefaultFormatter struct{}
 
-//XMLFormatter implements Formatter which formats metrics in XML suited for later parsing.
+//XMLFormatter implements Formatter which formats metrics in XML suited for later parsing. Timeframes are expressed in minutes.
 type XMLFormatter struct{}
 
 func (DefaultFormatter) Single(m WebMetric) string {
+	//Distributions are easier to read with one line per bucket
+	if h, ok := m.Output.(MetricHistogram); ok {
+		lines := strings.Split(strings.TrimSuffix(h.Format(false), "\n"), "\n")
+		return m.Source.Description() + " :\n\t\t" + strings.Join(lines, "\n\t\t")
+	}
 	//Each Metric on a single line
 	return m.Source.Description() + " : " + m.Output.Format(true)
 }
 
 func (f DefaultFormatter) Multiple(m WebMetrics) string {
-	//Website name
-	res := fmt.Sprintf("=== %v (last %v minutes) ===\n", m.WebsiteName, m.Timeframe)
+	//Website or group name, with labels and members
+	name := m.WebsiteName
+	if m.Members != nil {
+		name = "group " + name
+	}
+	res := fmt.Sprintf("=== %v (last %v) ===\n", name, spanString(m.Timeframe))
+	if len(m.Labels) > 0 {
+		res += fmt.Sprintf("\tLabels : %v\n", formatLabels(m.Labels))
+	}
+	if m.Members != nil {
+		res += fmt.Sprintf("\tMembers : %v\n", strings.Join(m.Members, ", "))
+	}
 	//Each metric with a tabulation
 	for _, v := range m.Metrics {
 		res += fmt.Sprintf("\t%v\n", f.Single(v))
@@ -62,11 +101,36 @@ func (DefaultFormatter) Suffix() string {
 }
 
 func (XMLFormatter) Single(m WebMetric) string {
-	return fmt.Sprintf("<metric><name>%v</name><description>%v</description><value>%v</value></metric>", m.Source.Name(), m.Source.Description(), m.Output.Format(true))
+	value := xmlEscape(m.Output.Format(true))
+	//Structured results are not flattened to a string
+	if x, ok := m.Output.(XMLResult); ok {
+		value = x.XML()
+	}
+	return fmt.Sprintf("<metric><name>%v</name><description>%v</description><value>%v</value></metric>", xmlEscape(m.Source.Name()), xmlEscape(m.Source.Description()), value)
 }
 
 func (f XMLFormatter) Multiple(m WebMetrics) string {
-	res := fmt.Sprintf("<metrics><website><name>%v</name></website><timeframe>%v</timeframe>", m.WebsiteName, m.Timeframe)
+	kind := "website"
+	members := ""
+	if m.Members != nil {
+		kind = "group"
+		members = "<members>"
+		for _, name := range m.Members {
+			members += fmt.Sprintf("<member>%v</member>", xmlEscape(name))
+		}
+		members += "</members>"
+	}
+	labels := ""
+	if len(m.Labels) > 0 {
+		labels = "<labels>"
+		for _, k := range sortedKeys(m.Labels) {
+			labels += fmt.Sprintf("<label><name>%v</name><value>%v</value></label>", xmlEscape(k), xmlEscape(m.Labels[k]))
+		}
+		labels += "</labels>"
+	}
+	//Timeframes are still expressed in minutes, possibly fractional for spans shorter than a minute
+	timeframe := strconv.FormatFloat(m.Timeframe.Minutes(), 'f', -1, 64)
+	res := fmt.Sprintf("<metrics><%v><name>%v</name>%v%v</%v><timeframe>%v</timeframe>", kind, xmlEscape(m.WebsiteName), labels, members, kind, timeframe)
 	for _, v := range m.Metrics {
 		res += f.Single(v)
 	}
@@ -86,6 +150,32 @@ func (XMLFormatter) Suffix() string {
 	return "</report>"
 }
 
+//xmlEscape escapes a string to be written as XML character data.
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+//sortedKeys returns the keys of a map of strings, sorted.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//formatLabels returns labels as a "key=value" list sorted by key.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for _, k := range sortedKeys(labels) {
+		pairs = append(pairs, k+"="+labels[k])
+	}
+	return strings.Join(pairs, ", ")
+}
+
 //Report allows to format and write multiple metrics for multiple website computed within a given timeframe.
 //It uses the Formatter to format (Metric, Result)s and the Logger to write the final result.
 func (r Reporter) Report(metrics []WebMetrics) {
@@ -103,13 +193,22 @@ func DefaultLogger() *log.Logger {
 }
 
 //FileLogger is a convenient function which returns a pointer to a logger which writes in a file.
-//Path is given in parameter.
-func FileLogger(path string) *log.Logger {
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, os.ModePerm)
+//Path is given in parameter. The file is never closed, see GetReporter for reporters with closable outputs.
+func FileLogger(path string) (*log.Logger, error) {
+	f, err := openOutput(path)
+	if err != nil {
+		return nil, err
+	}
+	return log.New(f, "", 0), nil
+}
+
+//openOutput opens a file for appending reports.
+func openOutput(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
-		log.Fatalf("Error while opening %s : %v", path, err)
+		return nil, fmt.Errorf("error while opening %s : %v", path, err)
 	}
-	return log.New(f, "", 0)
+	return f, nil
 }
 
 //Taken from : https://stackoverflow.com/a/21117347
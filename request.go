@@ -0,0 +1,146 @@
+package micromon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+//Request describes the HTTP request sent to a website : method (GET by default), headers, query parameters, body and authentication.
+//A "Host" header overrides the host sent to the server, not the one which is connected to.
+//Header values, body, bearer token and password may reference secrets instead of containing them, e.g. "env:API_TOKEN" or "file:/run/secrets/token".
+type Request struct {
+	Method      string
+	Headers     map[string]string
+	Query       map[string]string
+	Body        string
+	BasicAuth   *BasicAuth
+	BearerToken string
+}
+
+//BasicAuth holds credentials for HTTP basic authentication.
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+//newRequest builds the HTTP request described by a Request for a given URL, bound to a context.
+func newRequest(ctx context.Context, url string, website Request) (*http.Request, error) {
+	method := website.Method
+	if method == "" {
+		method = "GET"
+	}
+	var body io.Reader
+	if website.Body != "" {
+		body = strings.NewReader(website.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	//Only re-encode query if needed, to keep the URL as is otherwise
+	if len(website.Query) > 0 {
+		q := req.URL.Query()
+		for k, v := range website.Query {
+			q.Set(k, v)
+		}
+		req.URL.RawQuery = q.Encode()
+	}
+	for k, v := range website.Headers {
+		if http.CanonicalHeaderKey(k) == "Host" {
+			req.Host = v
+		} else {
+			req.Header.Set(k, v)
+		}
+	}
+	if website.BasicAuth != nil {
+		req.SetBasicAuth(website.BasicAuth.Username, website.BasicAuth.Password)
+	}
+	if website.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+website.BearerToken)
+	}
+	return req, nil
+}
+
+//resolveSecret returns the value referenced by a configuration value, so that secrets do not have to be written in the configuration file.
+//"env:NAME" references an environment variable and "file:/path" the content of a file, without trailing newline.
+//Other values are returned as is.
+func resolveSecret(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, "env:"):
+		name := strings.TrimPrefix(v, "env:")
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return val, nil
+	case strings.HasPrefix(v, "file:"):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(v, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return v, nil
+}
+
+//checkSecret checks the syntax of a configuration value which may reference a secret, without resolving it.
+func checkSecret(v string) error {
+	if v == "env:" || v == "file:" {
+		return fmt.Errorf("%s does not reference any secret", v)
+	}
+	return nil
+}
+
+//isSecret tells whether a configuration value references a secret.
+func isSecret(v string) bool {
+	return strings.HasPrefix(v, "env:") || strings.HasPrefix(v, "file:")
+}
+
+//checkSecrets checks the syntax of the secret references of a Request, without resolving them.
+func checkSecrets(w Request) error {
+	values := []string{w.Body, w.BearerToken}
+	for _, v := range w.Headers {
+		values = append(values, v)
+	}
+	if w.BasicAuth != nil {
+		values = append(values, w.BasicAuth.Password)
+	}
+	for _, v := range values {
+		if err := checkSecret(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//resolveSecrets returns a copy of a Request in which references in headers, body, basic and bearer authentication are resolved.
+func resolveSecrets(w Request) (Request, error) {
+	var err error
+	headers := make(map[string]string, len(w.Headers))
+	for k, v := range w.Headers {
+		if headers[k], err = resolveSecret(v); err != nil {
+			return w, err
+		}
+	}
+	w.Headers = headers
+	if w.Body, err = resolveSecret(w.Body); err != nil {
+		return w, err
+	}
+	if w.BearerToken, err = resolveSecret(w.BearerToken); err != nil {
+		return w, err
+	}
+	if w.BasicAuth != nil {
+		auth := *w.BasicAuth
+		if auth.Password, err = resolveSecret(auth.Password); err != nil {
+			return w, err
+		}
+		w.BasicAuth = &auth
+	}
+	return w, nil
+}
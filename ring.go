@@ -0,0 +1,75 @@
+package micromon
+
+import (
+	"sort"
+	"time"
+)
+
+//ring is a growable circular buffer of MetaResponse kept ordered by Timestamp.
+//Ordering allows window lookups by binary search instead of scanning all the samples.
+type ring struct {
+	buf   []MetaResponse
+	head  int
+	count int
+}
+
+//at returns a pointer to the i-th oldest element of the ring.
+func (r *ring) at(i int) *MetaResponse {
+	return &r.buf[(r.head+i)%len(r.buf)]
+}
+
+//len returns the number of elements held by the ring.
+func (r *ring) len() int {
+	return r.count
+}
+
+//grow doubles the capacity of the ring and moves elements at the beginning of the new buffer.
+func (r *ring) grow() {
+	size := 2 * len(r.buf)
+	if size == 0 {
+		size = 16
+	}
+	buf := make([]MetaResponse, size)
+	for i := 0; i < r.count; i++ {
+		buf[i] = *r.at(i)
+	}
+	r.buf = buf
+	r.head = 0
+}
+
+//push inserts a MetaResponse in the ring.
+//Samples of a website usually come in order, so insertion is most of the time a simple append.
+func (r *ring) push(m MetaResponse) {
+	if r.count == len(r.buf) {
+		r.grow()
+	}
+	i := r.count
+	r.count++
+	//Shift newer elements to keep the ring ordered
+	for ; i > 0 && r.at(i-1).Timestamp.After(m.Timestamp); i-- {
+		*r.at(i) = *r.at(i - 1)
+	}
+	*r.at(i) = m
+}
+
+//pop removes and returns the oldest element of the ring. The ring must not be empty.
+func (r *ring) pop() MetaResponse {
+	m := *r.at(0)
+	//Release references held by the sample
+	*r.at(0) = MetaResponse{}
+	r.head = (r.head + 1) % len(r.buf)
+	r.count--
+	return m
+}
+
+//since returns a copy of all elements which timestamp is not before from.
+func (r *ring) since(from time.Time) []MetaResponse {
+	first := sort.Search(r.count, func(i int) bool {
+		return !r.at(i).Timestamp.Before(from)
+	})
+	res := make([]MetaResponse, r.count-first)
+	for i := range res {
+		res[i] = *r.at(first + i)
+	}
+	return res
+}
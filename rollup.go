@@ -0,0 +1,199 @@
+package micromon
+
+import (
+	"strconv"
+	"time"
+)
+
+//Rollup aggregates all MetaResponse of a website produced within a time bucket.
+//It holds enough information to compute classic metrics without keeping raw responses.
+//Last is the timestamp of the newest MetaResponse aggregated. Failures counts unavailabilities per FailureReason.
+//MinResp, MaxResp, SumResp and Latency, the distribution of response times, only account for available responses.
+type Rollup struct {
+	Start     time.Time
+	Span      time.Duration
+	Last      time.Time
+	Count     int
+	Available int
+	Excluded  int
+	MinResp   time.Duration
+	MaxResp   time.Duration
+	SumResp   time.Duration
+	Codes     map[int]int
+	Failures  map[string]int
+	Latency   Sketch
+}
+
+//RollupMetric is implemented by metrics which can also be computed from a Rollup.
+//Such metrics can be computed over windows exceeding the raw data retention.
+type RollupMetric interface {
+	Metric
+	//ComputeRollup produces a Result from an aggregate of MetaResponse.
+	ComputeRollup(Rollup) Result
+}
+
+//rollupTiers defines the granularity of rollups and how long they are kept before being merged into the next tier.
+//Rollups of the last tier are dropped when they expire.
+var rollupTiers = []struct {
+	span   time.Duration
+	maxAge time.Duration
+}{
+	{time.Minute, 24 * time.Hour},
+	{time.Hour, 31 * 24 * time.Hour},
+	{24 * time.Hour, 400 * 24 * time.Hour},
+}
+
+//defaultRollupRawAge is the default raw data retention when rollups are enabled.
+const defaultRollupRawAge = MinuteDuration(24 * time.Hour)
+
+//add aggregates a MetaResponse into the Rollup.
+func (r *Rollup) add(m MetaResponse) {
+	o := Rollup{
+		Last:      m.Timestamp,
+		Count:     1,
+		Available: boolToInt(m.Available && !m.ExcludedFromAvailability),
+		Excluded:  boolToInt(m.ExcludedFromAvailability),
+		Codes:     map[int]int{m.Code: 1},
+	}
+	if m.Available {
+		o.MinResp, o.MaxResp, o.SumResp = m.RespDuration, m.RespDuration, m.RespDuration
+		o.Latency.Add(m.RespDuration)
+	} else {
+		o.Failures = map[string]int{string(m.Failure): 1}
+	}
+	r.merge(o)
+}
+
+//merge aggregates another Rollup into the Rollup. Start and Span are left untouched.
+func (r *Rollup) merge(o Rollup) {
+	if o.Count == 0 {
+		return
+	}
+	if o.Latency.Count > 0 && (r.Latency.Count == 0 || o.MinResp < r.MinResp) {
+		r.MinResp = o.MinResp
+	}
+	if o.MaxResp > r.MaxResp {
+		r.MaxResp = o.MaxResp
+	}
+	if o.Last.After(r.Last) {
+		r.Last = o.Last
+	}
+	r.Count += o.Count
+	r.Available += o.Available
+	r.Excluded += o.Excluded
+	r.SumResp += o.SumResp
+	if r.Codes == nil {
+		r.Codes = make(map[int]int)
+	}
+	for k, v := range o.Codes {
+		r.Codes[k] += v
+	}
+	if r.Failures == nil && len(o.Failures) > 0 {
+		r.Failures = make(map[string]int)
+	}
+	for k, v := range o.Failures {
+		r.Failures[k] += v
+	}
+	r.Latency.Merge(o.Latency)
+}
+
+//rollupOf aggregates a slice of MetaResponse into a single Rollup.
+func rollupOf(data []MetaResponse) Rollup {
+	r := Rollup{}
+	for _, m := range data {
+		r.add(m)
+	}
+	return r
+}
+
+//rollupTier holds time-ordered rollups of a given granularity.
+type rollupTier struct {
+	span    time.Duration
+	maxAge  time.Duration
+	buckets []Rollup
+}
+
+//newRollupTiers returns empty tiers as defined by rollupTiers.
+func newRollupTiers() []rollupTier {
+	tiers := make([]rollupTier, len(rollupTiers))
+	for i, t := range rollupTiers {
+		tiers[i] = rollupTier{span: t.span, maxAge: t.maxAge}
+	}
+	return tiers
+}
+
+//insert merges a Rollup into the bucket of the tier it belongs to, creating the bucket if needed.
+//Rollups are expected to come in time order.
+func (t *rollupTier) insert(r Rollup, at time.Time) {
+	start := at.Truncate(t.span)
+	n := len(t.buckets)
+	if n == 0 || !t.buckets[n-1].Start.Equal(start) {
+		t.buckets = append(t.buckets, Rollup{Start: start, Span: t.span})
+		n++
+	}
+	t.buckets[n-1].merge(r)
+}
+
+//rollUp aggregates a MetaResponse which ages out of raw data into the first tier, and cascades expired rollups to coarser tiers.
+func rollUp(tiers []rollupTier, m MetaResponse, now time.Time) {
+	tiers[0].insert(rollupOf([]MetaResponse{m}), m.Timestamp)
+	for i := range tiers {
+		t := &tiers[i]
+		for len(t.buckets) > 0 && now.Sub(t.buckets[0].Start.Add(t.span)) > t.maxAge {
+			if i+1 < len(tiers) {
+				tiers[i+1].insert(t.buckets[0], t.buckets[0].Start)
+			}
+			t.buckets = t.buckets[1:]
+		}
+	}
+}
+
+//rollupsSince merges all rollups of all tiers overlapping a window starting at a given time.
+//It returns false if no rollup overlaps the window.
+func rollupsSince(tiers []rollupTier, from time.Time) (Rollup, bool) {
+	res := Rollup{}
+	found := false
+	for _, t := range tiers {
+		for _, b := range t.buckets {
+			if b.Start.Add(b.Span).After(from) {
+				res.merge(b)
+				found = true
+			}
+		}
+	}
+	return res, found
+}
+
+//boolToInt converts true to 1 and false to 0.
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (AvgRespTime) ComputeRollup(r Rollup) Result {
+	if r.Latency.Count == 0 {
+		return MetricFloat(0)
+	}
+	return MetricFloat(float64(r.SumResp) / float64(time.Millisecond) / float64(r.Latency.Count))
+}
+
+func (MaxRespTime) ComputeRollup(r Rollup) Result {
+	return MetricFloat(float64(r.MaxResp) / float64(time.Millisecond))
+}
+
+func (CodeCount) ComputeRollup(r Rollup) Result {
+	res := make(MetricMap)
+	for k, v := range r.Codes {
+		res[strconv.Itoa(k)] = MetricInt(v)
+	}
+	return res
+}
+
+func (Availability) ComputeRollup(r Rollup) Result {
+	if r.Count == r.Excluded {
+		return nil
+	}
+	return MetricFloat(float64(r.Available) / float64(r.Count-r.Excluded) * 100)
+}
@@ -0,0 +1,387 @@
+package micromon
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Rule is a declarative alert rule of the configuration. It fires for a website or a group when its Metric, computed over
+//the last Window, compares to Threshold with Op (">", ">=", "<", "<=", "==" or "!=") for at least For.
+//Expr is a shorthand for these fields, e.g. "p95 > 800ms for 5m" or "codeCount[5xx] > 3" : a bracketed selector picks
+//entries of map metrics, such as status classes of codeCount or reasons of failureReasons. Thresholds may be durations,
+//compared in milliseconds as time metrics are, or percentages. Websites and Labels restrict the websites the rule applies to.
+//Rules are evaluated Every period, 10 seconds by default, over a Window of 2 minutes by default.
+//Alerts are sent to the Notify notifiers, or to all of them if none is given.
+type Rule struct {
+	Name      string
+	Expr      string
+	Metric    string
+	Op        string
+	Threshold string
+	Window    MinuteDuration
+	For       Duration
+	Every     Duration
+	Severity  string
+	Websites  []string
+	Labels    map[string]string
+	Notify    []string
+}
+
+//Default window, period and severity of rules.
+const (
+	defaultRuleWindow   = MinuteDuration(2 * time.Minute)
+	defaultRuleEvery    = Duration(10 * time.Second)
+	defaultRuleSeverity = "warning"
+)
+
+//ruleExprRegex matches rule expressions : metric, optional selector, operator, threshold and optional duration.
+var ruleExprRegex = regexp.MustCompile(`^\s*([\w:.,]+)(?:\[([^\]]+)\])?\s*(>=|<=|==|!=|>|<)\s*(\S+)(?:\s+for\s+(\S+))?\s*$`)
+
+//alertRule is a Rule ready to be evaluated.
+type alertRule struct {
+	Rule
+	metric    Metric
+	selector  string
+	threshold float64
+}
+
+//Alert is a transition of an alert rule for a website or a group : State is "firing" when the condition of the rule
+//has held for long enough, since Since, and "resolved" when it does not hold anymore. Value is the last value of the metric.
+type Alert struct {
+	Rule     string
+	Severity string
+	Website  string
+	Labels   map[string]string
+	State    string
+	Value    float64
+	Since    time.Time
+	At       time.Time
+}
+
+//ruleState is the state of a rule for a website : "pending" while its condition holds but not for long enough yet,
+//then "firing".
+type ruleState struct {
+	state string
+	since time.Time
+	value float64
+}
+
+//ruleEngine evaluates alert rules on computed metrics and keeps their state per rule and website.
+type ruleEngine struct {
+	rules  []alertRule
+	states map[string]map[string]*ruleState
+}
+
+//compile checks a Rule and prepares it for evaluation, setting default values.
+func (r Rule) compile() (alertRule, error) {
+	metric := r.Metric
+	if r.Expr != "" {
+		m := ruleExprRegex.FindStringSubmatch(r.Expr)
+		if m == nil {
+			return alertRule{}, fmt.Errorf("%q is not a valid rule expression, e.g. \"p95 > 800ms for 5m\"", r.Expr)
+		}
+		if m[2] != "" {
+			m[1] += "[" + m[2] + "]"
+		}
+		metric, r.Op, r.Threshold = m[1], m[3], m[4]
+		if m[5] != "" {
+			d, err := time.ParseDuration(m[5])
+			if err != nil {
+				return alertRule{}, err
+			}
+			r.For = Duration(d)
+		}
+		if r.Name == "" {
+			r.Name = r.Expr
+		}
+	}
+	a := alertRule{Rule: r}
+
+	//Metric and its selector
+	if i := strings.Index(metric, "["); i >= 0 && strings.HasSuffix(metric, "]") {
+		metric, a.selector = metric[:i], metric[i+1:len(metric)-1]
+	}
+	if metric == "" {
+		return a, fmt.Errorf("a rule needs an expression or a metric")
+	}
+	var err error
+	if a.metric, err = GetMetric(metric); err != nil {
+		return a, err
+	}
+
+	//Comparison
+	if _, err := compare(0, a.Op, 0); err != nil {
+		return a, err
+	}
+	if a.threshold, err = parseThreshold(a.Threshold); err != nil {
+		return a, err
+	}
+	if a.For < 0 || a.Window < 0 || a.Every < 0 {
+		return a, fmt.Errorf("durations must not be negative")
+	}
+
+	//Defaults
+	if a.Name == "" {
+		a.Name = fmt.Sprintf("%s %s %s", r.Metric, a.Op, a.Threshold)
+	}
+	if a.Window == 0 {
+		a.Window = defaultRuleWindow
+	}
+	if a.Every == 0 {
+		a.Every = defaultRuleEvery
+	}
+	if a.Severity == "" {
+		a.Severity = defaultRuleSeverity
+	}
+	return a, nil
+}
+
+//parseThreshold parses a threshold : a number, a percentage or a duration converted to milliseconds.
+func parseThreshold(s string) (float64, error) {
+	if v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64); err == nil {
+		return v, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return float64(d) / float64(time.Millisecond), nil
+	}
+	return 0, fmt.Errorf("%q is not a valid threshold", s)
+}
+
+//compare compares a value to a threshold with an operator.
+func compare(v float64, op string, threshold float64) (bool, error) {
+	switch op {
+	case ">":
+		return v > threshold, nil
+	case ">=":
+		return v >= threshold, nil
+	case "<":
+		return v < threshold, nil
+	case "<=":
+		return v <= threshold, nil
+	case "==":
+		return v == threshold, nil
+	case "!=":
+		return v != threshold, nil
+	}
+	return false, fmt.Errorf("%q is not a valid comparison operator", op)
+}
+
+//getRules returns the rules of the configuration, ready to be evaluated. Invalid rules are ignored with a warning.
+func getRules(conf Config) []alertRule {
+	rules := make([]alertRule, 0, len(conf.Rules))
+	for _, r := range conf.Rules {
+		a, err := r.compile()
+		if err != nil {
+			log.Printf("Warning : rule %s ignored : %v", r.Name, err)
+			continue
+		}
+		rules = append(rules, a)
+	}
+	return rules
+}
+
+//applies tells whether the rule applies to a website or a group.
+func (r alertRule) applies(m WebMetrics) bool {
+	if len(r.Websites) > 0 && !contains(r.Websites, m.WebsiteName) {
+		return false
+	}
+	return hasLabels(m.Labels, r.Labels)
+}
+
+//value returns the value of the metric of the rule among computed metrics, if it has been computed.
+//The availability of a group stands for the availability metric.
+func (r alertRule) value(metrics []WebMetric) (float64, bool) {
+	for _, m := range metrics {
+		_, isGroup := m.Source.(GroupAvailability)
+		_, wantsAvail := r.metric.(Availability)
+		if reflect.DeepEqual(m.Source, r.metric) || (isGroup && wantsAvail) {
+			return resultValue(m.Output, r.selector)
+		}
+	}
+	return 0, false
+}
+
+//resultValue converts a Result to a number. Entries of maps are summed, only those matching the selector if any :
+//status rules such as "5xx" for numeric keys, the exact key otherwise.
+func resultValue(res Result, selector string) (float64, bool) {
+	switch out := res.(type) {
+	case MetricFloat:
+		return float64(out), true
+	case MetricInt:
+		return float64(out), true
+	case MetricMap:
+		sum := float64(0)
+		for k, v := range out {
+			code, err := strconv.Atoi(k)
+			if selector != "" && k != selector && (err != nil || !matchStatus([]string{selector}, code)) {
+				continue
+			}
+			if n, ok := resultValue(v, ""); ok {
+				sum += n
+			}
+		}
+		return sum, true
+	}
+	return 0, false
+}
+
+//newRuleEngine returns an engine for the given rules.
+func newRuleEngine(rules []alertRule) *ruleEngine {
+	return &ruleEngine{rules: rules, states: make(map[string]map[string]*ruleState)}
+}
+
+//evaluate evaluates rules on computed metrics and returns transitions to firing and resolved states.
+//Websites which were alerted but have no metrics anymore are resolved.
+func (e *ruleEngine) evaluate(metrics []WebMetrics, now time.Time) []Alert {
+	alerts := make([]Alert, 0)
+	for _, r := range e.rules {
+		states, ok := e.states[r.Name]
+		if !ok {
+			states = make(map[string]*ruleState)
+			e.states[r.Name] = states
+		}
+		seen := make(map[string]bool)
+		for _, m := range metrics {
+			if !r.applies(m) {
+				continue
+			}
+			v, ok := r.value(m.Metrics)
+			if !ok {
+				continue
+			}
+			seen[m.WebsiteName] = true
+			holds, _ := compare(v, r.Op, r.threshold)
+			s, known := states[m.WebsiteName]
+			switch {
+			case holds && !known:
+				s = &ruleState{state: "pending", since: now}
+				states[m.WebsiteName] = s
+			case !holds && known:
+				delete(states, m.WebsiteName)
+				if s.state == "firing" {
+					alerts = append(alerts, r.alert(m, "resolved", v, s.since, now))
+				}
+				continue
+			case !holds:
+				continue
+			}
+			s.value = v
+			if s.state == "pending" && now.Sub(s.since) >= time.Duration(r.For) {
+				s.state = "firing"
+				alerts = append(alerts, r.alert(m, "firing", v, s.since, now))
+			}
+		}
+
+		//No metrics anymore, e.g. the website has been removed
+		for name, s := range states {
+			if !seen[name] {
+				delete(states, name)
+				if s.state == "firing" {
+					alerts = append(alerts, r.alert(WebMetrics{WebsiteName: name}, "resolved", s.value, s.since, now))
+				}
+			}
+		}
+	}
+	return alerts
+}
+
+//alert builds an Alert of the rule for a website.
+func (r alertRule) alert(m WebMetrics, state string, v float64, since time.Time, now time.Time) Alert {
+	return Alert{r.Name, r.Severity, m.WebsiteName, m.Labels, state, v, since, now}
+}
+
+func (a Alert) String() string {
+	if a.State == "resolved" {
+		return fmt.Sprintf("[%s] %s on %s resolved after %v. Value = %v", a.Severity, a.Rule, a.Website, a.At.Sub(a.Since).Round(time.Second), strconv.FormatFloat(a.Value, 'f', 3, 64))
+	}
+	return fmt.Sprintf("[%s] %s on %s is firing since %v. Value = %v", a.Severity, a.Rule, a.Website, a.Since.Format("2006/01/02 15:04:05"), strconv.FormatFloat(a.Value, 'f', 3, 64))
+}
+
+//ruleHook returns a Hook which evaluates rules, prints their transitions, records them as incidents and sends them to notifiers.
+//Ongoing incidents of the rules are resumed, e.g. after a restart.
+//It returns the state of the last transition, "firing" or "resolved", for testing purposes.
+func ruleHook(rules []alertRule, a *alerting) Hook {
+	engine := newRuleEngine(rules)
+	notify := make(map[string][]string, len(rules))
+	for _, r := range rules {
+		notify[r.Name] = r.Notify
+		states := make(map[string]*ruleState)
+		for _, i := range a.incidents.Query(IncidentQuery{Rule: r.Name, Ongoing: true}) {
+			states[i.Website] = &ruleState{state: "firing", since: i.Start, value: i.Value}
+		}
+		engine.states[r.Name] = states
+	}
+	return func(metrics []WebMetrics) string {
+		res := ""
+		for _, alert := range engine.evaluate(metrics, time.Now()) {
+			log.Printf("==== ALERT RULES ====\n%v\n\n", alert)
+			a.incidents.record(alert, "")
+			a.notify(alert, notify[alert.Rule])
+			res = alert.State
+		}
+		return res
+	}
+}
+
+//ruleSchedules returns a Schedule for each window and period of the rules of the configuration. They compute the metrics
+//of their rules, for websites and groups, feed the rules hook and are not reported.
+func ruleSchedules(conf Config, a *alerting) []Schedule {
+	type key struct {
+		window MinuteDuration
+		every  Duration
+	}
+	byKey := make(map[key][]alertRule)
+	keys := make([]key, 0)
+	for _, r := range getRules(conf) {
+		k := key{r.Window, r.Every}
+		if _, ok := byKey[k]; !ok {
+			keys = append(keys, k)
+		}
+		byKey[k] = append(byKey[k], r)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].window < keys[j].window || (keys[i].window == keys[j].window && keys[i].every < keys[j].every)
+	})
+
+	schedules := make([]Schedule, 0, len(keys))
+	for _, k := range keys {
+		rules := byKey[k]
+		metrics := make([]Metric, 0)
+		for _, r := range rules {
+			metrics = appendMetric(metrics, r.metric)
+		}
+		groups := GetGroups(conf)
+		for i := range groups {
+			groups[i].Metrics = make([]Metric, 0)
+			for _, m := range metrics {
+				if _, ok := m.(Availability); !ok {
+					groups[i].Metrics = append(groups[i].Metrics, m)
+				}
+			}
+		}
+		schedules = append(schedules, Schedule{
+			Timeframe: Timeframe{Name: "rules " + k.window.String(), Span: k.window, Every: k.every, NoReport: true},
+			Hooks:     []Hook{ruleHook(rules, a)},
+			Groups:    groups,
+			Metrics:   &SiteMetrics{Default: metrics},
+			alerting:  a,
+		})
+	}
+	return schedules
+}
+
+//appendMetric appends a Metric to a slice, unless it is already in it.
+func appendMetric(metrics []Metric, m Metric) []Metric {
+	for _, v := range metrics {
+		if reflect.DeepEqual(v, m) {
+			return metrics
+		}
+	}
+	return append(metrics, m)
+}
@@ -0,0 +1,223 @@
+package micromon
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+//Timeframe describes a named window over which metrics are periodically computed.
+//Span is the width of the window, Every is the computation period. In the configuration file, integers are minutes
+//for Span and seconds for Every.
+//Results are reported with the Timeframe's Format and Output, which default to the global ones, and are fed to its Hooks.
+//NoReport disables reporting, which is useful for timeframes which only feed hooks (e.g. alerting).
+//The alert and cert hooks may only be used by one timeframe : they share incidents and notifiers, so that
+//each transition would otherwise be notified once per timeframe.
+type Timeframe struct {
+	Name     string
+	Span     MinuteDuration
+	Every    Duration
+	Format   string
+	Output   string
+	Hooks    []string
+	NoReport bool
+}
+
+//Schedule binds a Timeframe with the Reporter and the Hooks it feeds, along with the groups to compute.
+//Reporter is nil if the Timeframe is not reported. Metrics, if not nil, replaces the metrics of websites, e.g. for alert rules.
+type Schedule struct {
+	Timeframe Timeframe
+	Reporter  *Reporter
+	Hooks     []Hook
+	Groups    []WebGroup
+	Metrics   *SiteMetrics
+	alerting  *alerting
+}
+
+//defaultTimeframes returns the timeframes used when none is declared in the configuration.
+//It mimics historical behaviour : last 2 and 10 minutes every 10 seconds, last hour every minute.
+//Hooks are only applied on the shortest timeframe to avoid repeating alerts : global hooks and hooks of websites.
+func defaultTimeframes(conf Config) []Timeframe {
+	hooks := append([]string{}, conf.Hooks...)
+	for _, w := range conf.Websites {
+		for _, h := range w.Hooks {
+			if !contains(hooks, h) {
+				hooks = append(hooks, h)
+			}
+		}
+	}
+	return []Timeframe{
+		{Name: "2m", Span: MinuteDuration(2 * time.Minute), Every: Duration(10 * time.Second), Hooks: hooks},
+		{Name: "10m", Span: MinuteDuration(10 * time.Minute), Every: Duration(10 * time.Second)},
+		{Name: "1h", Span: MinuteDuration(time.Hour), Every: Duration(time.Minute)},
+	}
+}
+
+//GetTimeframes returns the valid timeframes of the configuration, or default timeframes if none is declared.
+func GetTimeframes(conf Config) []Timeframe {
+	if len(conf.Timeframes) == 0 {
+		return defaultTimeframes(conf)
+	}
+	timeframes := make([]Timeframe, 0)
+	for _, tf := range conf.Timeframes {
+		if tf.Span <= 0 || tf.Every <= 0 {
+			log.Printf("Warning : timeframe %s ignored, span and period must be positive", tf.Name)
+		} else {
+			timeframes = append(timeframes, tf)
+		}
+	}
+	return timeframes
+}
+
+//GetSchedules returns a Schedule for each Timeframe of the configuration, followed by the schedules of alert rules.
+//Each Schedule has its own Reporter and its own Hook instances, so hooks states are not shared between timeframes.
+//Notifiers, the incident history, maintenance windows and silences are shared by all schedules.
+//Ongoing incidents of rules and websites which are not in the configuration anymore are ended.
+//It returns a non-nil error if a reporter, the incident history or silences cannot be opened.
+func GetSchedules(conf Config) ([]Schedule, error) {
+	incidents, err := OpenIncidentHistory(conf)
+	if err != nil {
+		return nil, err
+	}
+	silences, err := OpenSilences(conf)
+	if err != nil {
+		return nil, err
+	}
+	schedules, err := getSchedules(conf, incidents, silences)
+	if err != nil {
+		return nil, err
+	}
+	incidents.resolve(activeIncidents(conf), time.Now())
+	return schedules, nil
+}
+
+//getSchedules is like GetSchedules, with the given incident history and silences, but does not end incidents :
+//the caller ends them with resolve once the schedules are used, so that rejected schedules have no side effect.
+func getSchedules(conf Config, incidents *IncidentHistory, silences *Silences) ([]Schedule, error) {
+	schedules := make([]Schedule, 0)
+	a := &alerting{getNotifiers(conf), incidents, getMaintenances(conf), silences}
+	for _, tf := range GetTimeframes(conf) {
+		//Reuse configuration-based builders with timeframe-specific values
+		tfConf := conf
+		tfConf.Hooks = tf.Hooks
+		if tf.Format != "" {
+			tfConf.Format = tf.Format
+		}
+		if tf.Output != "" {
+			tfConf.Output = tf.Output
+		}
+
+		//Default timeframes also gather hooks of websites, which only apply to the websites listing them
+		defaults := tf.Hooks
+		if len(conf.Timeframes) == 0 {
+			defaults = conf.Hooks
+		}
+
+		s := Schedule{Timeframe: tf, Hooks: getHooks(tfConf, defaults, a), Groups: GetGroups(conf), alerting: a}
+		if !tf.NoReport {
+			reporter, err := GetReporter(tfConf)
+			if err != nil {
+				//Do not leak reporters already opened
+				for _, prev := range schedules {
+					prev.close()
+				}
+				a.notifiers.close()
+				return nil, err
+			}
+			s.Reporter = &reporter
+		}
+		schedules = append(schedules, s)
+	}
+	schedules = append(schedules, ruleSchedules(conf, a)...)
+	return schedules, nil
+}
+
+//activeIncidents returns a function which tells whether an incident may still be ended by a hook of the configuration :
+//its website or group exists, and its rule is configured, or it is an availability or a certificate incident and
+//the alert or the cert hook is used.
+func activeIncidents(conf Config) func(Incident) bool {
+	rules := make(map[string]bool)
+	for _, r := range getRules(conf) {
+		rules[r.Name] = true
+	}
+	for _, tf := range GetTimeframes(conf) {
+		if contains(tf.Hooks, "alert") {
+			rules["availability"] = true
+		}
+		if contains(tf.Hooks, "cert") {
+			rules["certificateExpiry"], rules["certificateInvalid"] = true, true
+		}
+	}
+	return func(i Incident) bool {
+		_, isWebsite := conf.Websites[i.Website]
+		_, isGroup := conf.Groups[i.Website]
+		return (isWebsite || isGroup) && rules[i.Rule]
+	}
+}
+
+//Run computes metrics over the Schedule's Timeframe at the given period, applies hooks and reports results.
+//It returns when the context is cancelled and is meant to be run in its own goroutine.
+func (s Schedule) Run(ctx context.Context, datas *respMap, metrics SiteMetrics) {
+	ticker := time.NewTicker(time.Duration(s.Timeframe.Every))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			res := s.compute(datas, metrics)
+			for _, h := range s.Hooks {
+				h(res)
+			}
+			if s.Reporter != nil {
+				s.Reporter.Report(res)
+			}
+		}
+	}
+}
+
+//report computes and reports metrics over the Schedule's Timeframe once, without applying hooks.
+func (s Schedule) report(datas *respMap, metrics SiteMetrics) {
+	if s.Reporter != nil {
+		s.Reporter.Report(s.compute(datas, metrics))
+	}
+}
+
+//compute computes metrics of websites and groups over the Schedule's Timeframe.
+func (s Schedule) compute(datas *respMap, metrics SiteMetrics) []WebMetrics {
+	span := time.Duration(s.Timeframe.Span)
+	if s.Metrics != nil {
+		metrics = *s.Metrics
+	}
+	return append(datas.ComputeSiteMetrics(metrics, span), datas.ComputeGroupMetrics(s.Groups, span)...)
+}
+
+//close closes the Reporter of the Schedule, if any. Notifiers are shared by schedules, see closeSchedules.
+func (s Schedule) close() error {
+	if s.Reporter != nil {
+		return s.Reporter.Close()
+	}
+	return nil
+}
+
+//closeSchedules closes the reporters of schedules, then the notifiers they share, once, returning the first error met.
+//Unless wait is set, notifiers are closed in background, as delivering pending notifications may take up to notifyDrainTimeout.
+func closeSchedules(schedules []Schedule, wait bool) error {
+	var err error
+	closed := make(map[*notifiers]bool)
+	for _, s := range schedules {
+		if e := s.close(); err == nil {
+			err = e
+		}
+		if s.alerting == nil || closed[s.alerting.notifiers] {
+			continue
+		}
+		closed[s.alerting.notifiers] = true
+		if wait {
+			s.alerting.notifiers.close()
+		} else {
+			go s.alerting.notifiers.close()
+		}
+	}
+	return err
+}
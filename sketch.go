@@ -0,0 +1,77 @@
+package micromon
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+//sketchAccuracy is the relative accuracy of quantiles estimated by a Sketch.
+const sketchAccuracy = 0.01
+
+//sketchGamma is the ratio between the bounds of a Sketch bucket, derived from its accuracy.
+var sketchGamma = (1 + sketchAccuracy) / (1 - sketchAccuracy)
+
+//Sketch is a mergeable summary of a distribution of durations, from which quantiles can be estimated.
+//Durations are counted in logarithmic buckets, which guarantees a bounded relative error on estimations
+//whatever the number of values, and makes sketches of different rollups easy to merge (see DDSketch).
+//Zero durations are counted apart.
+type Sketch struct {
+	Count   int
+	Zeros   int
+	Buckets map[int]int
+}
+
+//Add counts a duration in the Sketch.
+func (s *Sketch) Add(d time.Duration) {
+	s.Count++
+	if d <= 0 {
+		s.Zeros++
+		return
+	}
+	if s.Buckets == nil {
+		s.Buckets = make(map[int]int)
+	}
+	s.Buckets[int(math.Ceil(math.Log(float64(d))/math.Log(sketchGamma)))]++
+}
+
+//Merge adds all durations counted by another Sketch.
+func (s *Sketch) Merge(o Sketch) {
+	s.Count += o.Count
+	s.Zeros += o.Zeros
+	if s.Buckets == nil && len(o.Buckets) > 0 {
+		s.Buckets = make(map[int]int, len(o.Buckets))
+	}
+	for k, v := range o.Buckets {
+		s.Buckets[k] += v
+	}
+}
+
+//Quantile estimates the duration below which a given fraction q (between 0 and 1) of counted durations falls.
+func (s Sketch) Quantile(q float64) time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	rank := int(q * float64(s.Count-1))
+	seen := s.Zeros
+	if rank < seen {
+		return 0
+	}
+	keys := make([]int, 0, len(s.Buckets))
+	for k := range s.Buckets {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	for _, k := range keys {
+		seen += s.Buckets[k]
+		if rank < seen {
+			return sketchValue(k)
+		}
+	}
+	return 0
+}
+
+//sketchValue returns the estimated duration of a Sketch bucket, i.e. its middle in terms of relative error.
+func sketchValue(k int) time.Duration {
+	return time.Duration(2 * math.Pow(sketchGamma, float64(k)) / (sketchGamma + 1))
+}
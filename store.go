@@ -0,0 +1,387 @@
+package micromon
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Store defines a storage backend for MetaResponse.
+//Computations always operate on the in-memory respMap ; a Store is written through by Start() so that
+//history can be reloaded into the respMap when MicroMon restarts.
+type Store interface {
+	//Append durably records a MetaResponse, according to the backend policy.
+	Append(MetaResponse) error
+	//Replay calls a function for each recorded MetaResponse produced after a given time, in insertion order.
+	Replay(since time.Time, fn func(MetaResponse)) error
+	//SaveRollups replaces recorded rollups with the ones of each website given in parameter.
+	SaveRollups(map[string][]Rollup) error
+	//LoadRollups returns recorded rollups of each website.
+	LoadRollups() (map[string][]Rollup, error)
+	//Close flushes pending data and releases resources.
+	Close() error
+}
+
+//StorageConf mirrors the storage section of the configuration file.
+//Type is either "memory" (default) or "file". Path is the directory holding segments for the file backend.
+//Fsync is either "always", "interval" (at most once per FsyncInterval, 1 second by default) or "never". SegmentSize is expressed in bytes.
+type StorageConf struct {
+	Type          string
+	Path          string
+	Fsync         string
+	FsyncInterval Duration
+	SegmentSize   int64
+}
+
+//GetStore instantiates a Store from a storage configuration and a retention policy.
+//If no corresponding backend is found, a non-nil error is returned.
+func GetStore(conf StorageConf, r Retention) (Store, error) {
+	switch conf.Type {
+	case "", "memory":
+		return MemoryStore{}, nil
+	case "file":
+		return OpenFileStore(conf, r)
+	}
+	return nil, fmt.Errorf("%s is not a known storage type", conf.Type)
+}
+
+//validate checks that the storage configuration is usable.
+func (c StorageConf) validate() error {
+	switch c.Type {
+	case "", "memory":
+	case "file":
+		if c.Path == "" {
+			return fmt.Errorf("file storage needs a path")
+		}
+	default:
+		return fmt.Errorf("%s is not a known storage type", c.Type)
+	}
+	switch c.Fsync {
+	case "", "always", "interval", "never":
+	default:
+		return fmt.Errorf("%s is not a known fsync policy", c.Fsync)
+	}
+	if c.FsyncInterval < 0 || c.SegmentSize < 0 {
+		return fmt.Errorf("fsync interval and segment size must not be negative")
+	}
+	return nil
+}
+
+//MemoryStore implements Store and does not record anything : data only lives in the respMap.
+type MemoryStore struct{}
+
+func (MemoryStore) Append(MetaResponse) error {
+	return nil
+}
+
+func (MemoryStore) Replay(time.Time, func(MetaResponse)) error {
+	return nil
+}
+
+func (MemoryStore) SaveRollups(map[string][]Rollup) error {
+	return nil
+}
+
+func (MemoryStore) LoadRollups() (map[string][]Rollup, error) {
+	return nil, nil
+}
+
+func (MemoryStore) Close() error {
+	return nil
+}
+
+//Default values for the file backend.
+const (
+	defaultSegmentSize   = 4 << 20
+	defaultFsyncInterval = Duration(time.Second)
+	segmentExt           = ".seg"
+	maxRecordSize        = 1 << 20
+	rollupsFile          = "rollups.json"
+)
+
+//FileStore implements Store with append-only segment files in a directory.
+//Each record is a length and a CRC32 checksum followed by the JSON encoded MetaResponse, so that a record
+//partially written during a crash is detected and truncated when the store is reopened.
+//Segments are rotated when they exceed a given size, and whole segments older than the retention are deleted.
+type FileStore struct {
+	conf     StorageConf
+	maxAge   time.Duration
+	mux      sync.Mutex
+	seq      int
+	file     *os.File
+	size     int64
+	lastSync time.Time
+}
+
+//OpenFileStore opens or creates a FileStore in the configured directory and repairs its last segment if needed.
+func OpenFileStore(conf StorageConf, r Retention) (*FileStore, error) {
+	if conf.Path == "" {
+		return nil, fmt.Errorf("file storage needs a path")
+	}
+	if conf.SegmentSize <= 0 {
+		conf.SegmentSize = defaultSegmentSize
+	}
+	if conf.FsyncInterval <= 0 {
+		conf.FsyncInterval = defaultFsyncInterval
+	}
+	switch conf.Fsync {
+	case "":
+		conf.Fsync = "interval"
+	case "always", "interval", "never":
+	default:
+		return nil, fmt.Errorf("%s is not a known fsync policy", conf.Fsync)
+	}
+	if err := os.MkdirAll(conf.Path, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &FileStore{conf: conf, maxAge: time.Duration(r.MaxAge), lastSync: time.Now()}
+	segs, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	//Resume the last segment after dropping any torn record, or start the first one
+	if len(segs) == 0 {
+		return s, s.openSegment(1)
+	}
+	last := segs[len(segs)-1]
+	valid, err := scanSegment(s.segmentPath(last), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Truncate(s.segmentPath(last), valid); err != nil {
+		return nil, err
+	}
+	return s, s.openSegment(last)
+}
+
+//segmentPath returns the path of the segment with a given sequence number.
+func (s *FileStore) segmentPath(seq int) string {
+	return filepath.Join(s.conf.Path, fmt.Sprintf("%010d%s", seq, segmentExt))
+}
+
+//segments returns the sorted sequence numbers of existing segments.
+func (s *FileStore) segments() ([]int, error) {
+	files, err := ioutil.ReadDir(s.conf.Path)
+	if err != nil {
+		return nil, err
+	}
+	segs := make([]int, 0)
+	for _, f := range files {
+		var seq int
+		if !strings.HasSuffix(f.Name(), segmentExt) {
+			continue
+		}
+		if _, err := fmt.Sscanf(f.Name(), "%d"+segmentExt, &seq); err == nil {
+			segs = append(segs, seq)
+		}
+	}
+	sort.Ints(segs)
+	return segs, nil
+}
+
+//openSegment opens a segment for appending and makes it the active one.
+func (s *FileStore) openSegment(seq int) error {
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file, s.seq, s.size = f, seq, info.Size()
+	return nil
+}
+
+//rotate closes the active segment, starts a new one and deletes expired segments.
+func (s *FileStore) rotate() error {
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	if err := s.openSegment(s.seq + 1); err != nil {
+		return err
+	}
+	return s.prune()
+}
+
+//prune deletes inactive segments which last write is older than the retention.
+func (s *FileStore) prune() error {
+	if s.maxAge == 0 {
+		return nil
+	}
+	segs, err := s.segments()
+	if err != nil {
+		return err
+	}
+	for _, seq := range segs {
+		if seq == s.seq {
+			continue
+		}
+		info, err := os.Stat(s.segmentPath(seq))
+		if err == nil && time.Since(info.ModTime()) > s.maxAge {
+			if err := os.Remove(s.segmentPath(seq)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *FileStore) Append(m MetaResponse) error {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	//Record header : payload length and checksum
+	record := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[8:], payload)
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.size > 0 && s.size+int64(len(record)) > s.conf.SegmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(record)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	//Apply fsync policy
+	now := time.Now()
+	if s.conf.Fsync == "always" || (s.conf.Fsync == "interval" && now.Sub(s.lastSync) >= time.Duration(s.conf.FsyncInterval)) {
+		s.lastSync = now
+		return s.file.Sync()
+	}
+	return nil
+}
+
+func (s *FileStore) Replay(since time.Time, fn func(MetaResponse)) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	segs, err := s.segments()
+	if err != nil {
+		return err
+	}
+	for _, seq := range segs {
+		_, err := scanSegment(s.segmentPath(seq), func(m MetaResponse) {
+			if !m.Timestamp.Before(since) {
+				fn(m)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//SaveRollups writes rollups in a temporary file which atomically replaces the previous one.
+func (s *FileStore) SaveRollups(rollups map[string][]Rollup) error {
+	data, err := json.Marshal(rollups)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(filepath.Join(s.conf.Path, rollupsFile), data)
+}
+
+//writeAtomic writes data in a temporary file which atomically replaces the file which path is given in parameter.
+func writeAtomic(path string, data []byte) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *FileStore) LoadRollups() (map[string][]Rollup, error) {
+	rollups := make(map[string][]Rollup)
+	data, err := ioutil.ReadFile(filepath.Join(s.conf.Path, rollupsFile))
+	if os.IsNotExist(err) {
+		return rollups, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rollups, json.Unmarshal(data, &rollups)
+}
+
+func (s *FileStore) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+//scanSegment reads all valid records of a segment and calls a function for each of them, if not nil.
+//Reading stops at the first torn or corrupted record. It returns the offset following the last valid record.
+func scanSegment(path string, fn func(MetaResponse)) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	offset := int64(0)
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		if size > maxRecordSize {
+			log.Printf("Warning : corrupted record in %s at offset %d, ignoring the end of the segment", path, offset)
+			break
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+		var m MetaResponse
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) || json.Unmarshal(payload, &m) != nil {
+			log.Printf("Warning : corrupted record in %s at offset %d, ignoring the end of the segment", path, offset)
+			break
+		}
+		if fn != nil {
+			fn(m)
+		}
+		offset += int64(len(header) + len(payload))
+	}
+	return offset, nil
+}
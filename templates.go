@@ -0,0 +1,138 @@
+package micromon
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+//applyTemplates returns the websites of a configuration with their templates applied : each setting which is not set
+//by a website is inherited from its template, which may itself inherit from another template.
+//Maps such as headers are merged key by key. Errors are returned by website name, e.g. for unknown templates or cycles.
+func applyTemplates(conf Config) (map[string]Website, map[string]error) {
+	websites := make(map[string]Website, len(conf.Websites))
+	errs := make(map[string]error)
+	for name, w := range conf.Websites {
+		res, err := withTemplate(conf.Templates, w, nil)
+		if err != nil {
+			errs[name] = err
+		}
+		websites[name] = res
+	}
+	return websites, errs
+}
+
+//withTemplate applies the template chain of a website. Seen holds the templates already applied, to detect cycles.
+func withTemplate(templates map[string]Website, w Website, seen []string) (Website, error) {
+	if w.Template == "" {
+		return w, nil
+	}
+	for _, s := range seen {
+		if s == w.Template {
+			return w, fmt.Errorf("templates inherit from each other : %s", strings.Join(append(seen, w.Template), " -> "))
+		}
+	}
+	t, ok := templates[w.Template]
+	if !ok {
+		return w, fmt.Errorf("%s is not a known template", w.Template)
+	}
+	t, err := withTemplate(templates, t, append(seen, w.Template))
+	if err != nil {
+		return w, err
+	}
+	inherit(reflect.ValueOf(&w).Elem(), reflect.ValueOf(t))
+	return w, nil
+}
+
+//inherit sets the zero fields of a structure to the values of another one of the same type.
+//Nested structures are inherited field by field and maps key by key.
+func inherit(dst reflect.Value, src reflect.Value) {
+	for i := 0; i < dst.NumField(); i++ {
+		f, s := dst.Field(i), src.Field(i)
+		if !f.CanSet() {
+			continue
+		}
+		switch {
+		case f.Kind() == reflect.Struct:
+			inherit(f, s)
+		case f.Kind() == reflect.Map && !f.IsNil() && !s.IsNil():
+			merged := reflect.MakeMap(f.Type())
+			for _, k := range s.MapKeys() {
+				merged.SetMapIndex(k, s.MapIndex(k))
+			}
+			for _, k := range f.MapKeys() {
+				merged.SetMapIndex(k, f.MapIndex(k))
+			}
+			f.Set(merged)
+		case f.IsZero():
+			f.Set(s)
+		}
+	}
+}
+
+//availThreshold returns the availability threshold of a website : its own one, or the global one.
+func (conf Config) availThreshold(name string) float64 {
+	if t := conf.Websites[name].AvailThreshold; t > 0 {
+		return t
+	}
+	return conf.AvailThreshold
+}
+
+//hysteresis returns the hysteresis settings of a website : its own ones override the global ones field by field,
+//and unset fields get their default value.
+func (conf Config) hysteresis(name string) Hysteresis {
+	h := conf.Websites[name].Hysteresis
+	inherit(reflect.ValueOf(&h).Elem(), reflect.ValueOf(conf.Hysteresis))
+	if h.RecoveryThreshold == 0 {
+		h.RecoveryThreshold = conf.availThreshold(name)
+	}
+	if h.Consecutive == 0 {
+		h.Consecutive = 1
+	}
+	if h.FlapWindow == 0 {
+		h.FlapWindow = defaultFlapWindow
+	}
+	return h
+}
+
+//certThresholds returns the certificate expiry thresholds of a website : its own ones, the global ones, or the default ones.
+func (conf Config) certThresholds(name string) []int {
+	if t := conf.Websites[name].CertThresholds; len(t) > 0 {
+		return t
+	}
+	if len(conf.CertThresholds) > 0 {
+		return conf.CertThresholds
+	}
+	return defaultCertThresholds
+}
+
+//hookEnabled tells whether a hook applies to a website : its own hooks if it lists some, the given default hooks otherwise.
+func (conf Config) hookEnabled(hook string, name string, defaults []string) bool {
+	if hooks := conf.Websites[name].Hooks; len(hooks) > 0 {
+		return contains(hooks, hook)
+	}
+	return contains(defaults, hook)
+}
+
+//contains tells whether a slice of strings contains a string.
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+//websitesHook restricts a hook to the websites it applies to, see hookEnabled.
+func websitesHook(name string, conf Config, defaults []string, h Hook) Hook {
+	return func(metrics []WebMetrics) string {
+		filtered := make([]WebMetrics, 0, len(metrics))
+		for _, m := range metrics {
+			if conf.hookEnabled(name, m.WebsiteName, defaults) {
+				filtered = append(filtered, m)
+			}
+		}
+		return h(filtered)
+	}
+}
@@ -1,8 +1,33 @@
 package micromon
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"time"
+
+	"gopkg.in/yaml.v2"
 )
 
 //TestAlerting tests the alerting logic. It simulates a real word situation and configuration.
@@ -18,18 +43,20 @@ func TestAlerting() bool {
 
 	//Create minimal configuration
 	webserv := make(map[string]Website)
-	webserv["localhost"] = Website{"http://localhost:8080", 1}
-	conf := Config{Websites: webserv, Timeout: 3, AvailThreshold: 50}
+	webserv["localhost"] = Website{URL: "http://localhost:8080", Interval: Duration(time.Second)}
+	conf := Config{Websites: webserv, Timeout: Duration(3 * time.Second), AvailThreshold: 50}
 
-	//Gather incoming MetaResponse
-	ch := WatchWebsites(conf)
+	//Gather incoming MetaResponse until the end of the test
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := WatchWebsites(ctx, conf)
+	if err != nil {
+		return false
+	}
 	data := NewSafeData()
 	go func() {
-		for {
-			resp := <-ch
-			data.Mux.Lock()
-			data.Datas = append(data.Datas, resp)
-			data.Mux.Unlock()
+		for resp := range ch {
+			data.Add(resp)
 		}
 	}()
 
@@ -38,14 +65,14 @@ func TestAlerting() bool {
 
 	//Local webserver is available, hook should not return anything
 	time.Sleep(2 * time.Second)
-	if getAvailStatus(data.Datas, conf, hook) != "" {
+	if getAvailStatus(data.Since(time.Minute), conf, hook) != "" {
 		return false
 	}
 
 	//We shutdown local webserver, hook should detect a new unavailability
 	srv.Close()
 	time.Sleep(2 * time.Second)
-	if getAvailStatus(data.Datas, conf, hook) != "unavailable" {
+	if getAvailStatus(data.Since(time.Minute), conf, hook) != "unavailable" {
 		return false
 	}
 
@@ -53,7 +80,7 @@ func TestAlerting() bool {
 	srv = startHttpServer()
 	time.Sleep(2 * time.Second)
 	defer srv.Close()
-	if getAvailStatus(data.Datas, conf, hook) != "recovered" {
+	if getAvailStatus(data.Since(time.Minute), conf, hook) != "recovered" {
 		return false
 	}
 
@@ -70,7 +97,7 @@ func dummyResponse(w http.ResponseWriter, r *http.Request) {
 func getAvailStatus(resp []MetaResponse, conf Config, alertHook Hook) string {
 	avail := Availability{}.Compute(resp)
 	dummyWebs := make([]WebMetrics, 1)
-	dummyWeb := WebMetrics{10, "localhost", make([]WebMetric, 1)}
+	dummyWeb := WebMetrics{Timeframe: 10 * time.Minute, WebsiteName: "localhost", Metrics: make([]WebMetric, 1)}
 	dummyWeb.Metrics = append(dummyWeb.Metrics, WebMetric{Availability{}, avail})
 	dummyWebs = append(dummyWebs, dummyWeb)
 	return alertHook(dummyWebs)
@@ -84,3 +111,1718 @@ func startHttpServer() *http.Server {
 	}()
 	return srv
 }
+
+//TestFileStore tests the persistence logic. It records some MetaResponse in a FileStore, simulates a torn write
+//by appending garbage to the active segment, and reopens the store as MicroMon would do on restart.
+//It checks that all complete records are replayed and that the store can still be appended to.
+//If all theses conditions are met, it returns true ; false otherwise.
+func TestFileStore() bool {
+	dir, err := ioutil.TempDir("", "micromon")
+	if err != nil {
+		return false
+	}
+	defer os.RemoveAll(dir)
+	conf := StorageConf{Type: "file", Path: dir, Fsync: "always", SegmentSize: 512}
+
+	//Record enough responses to span multiple segments
+	store, err := OpenFileStore(conf, Retention{})
+	if err != nil {
+		return false
+	}
+	for i := 0; i < 10; i++ {
+		if store.Append(MetaResponse{Name: "localhost", Code: 200, Timestamp: time.Now(), Available: true}) != nil {
+			return false
+		}
+	}
+	store.file.Write([]byte{0, 0, 1, 0, 42})
+	store.Close()
+
+	//Reopen store : torn record should be ignored and overwritten by new records
+	store, err = OpenFileStore(conf, Retention{})
+	if err != nil {
+		return false
+	}
+	defer store.Close()
+	if store.Append(MetaResponse{Name: "localhost", Code: 500, Timestamp: time.Now()}) != nil {
+		return false
+	}
+	count := 0
+	store.Replay(time.Time{}, func(MetaResponse) { count++ })
+	if count != 11 {
+		return false
+	}
+
+	//With the interval policy, appends within the default interval are not synced
+	conf.Fsync, conf.Path = "interval", filepath.Join(dir, "interval")
+	synced, err := OpenFileStore(conf, Retention{})
+	if err != nil {
+		return false
+	}
+	defer synced.Close()
+	opened := synced.lastSync
+	for i := 0; i < 3; i++ {
+		if synced.Append(MetaResponse{Name: "localhost", Code: 200, Timestamp: time.Now(), Available: true}) != nil {
+			return false
+		}
+	}
+	return synced.conf.FsyncInterval == Duration(time.Second) && synced.lastSync.Equal(opened)
+}
+
+//TestRollups tests the downsampling logic. It feeds a website with one MetaResponse per minute for the last 3 hours,
+//one out of four being unavailable, while only the last hour of raw data is retained.
+//It checks that the availability over the last 4 hours is computed from rollups and accounts for all responses.
+//If all theses conditions are met, it returns true ; false otherwise.
+func TestRollups() bool {
+	now := time.Now()
+	data := NewBoundedSafeData(Retention{MaxAge: MinuteDuration(time.Hour), Rollups: true})
+	for i := 180; i > 0; i-- {
+		data.Add(MetaResponse{Name: "localhost", Code: 200, Timestamp: now.Add(-time.Duration(i) * time.Minute), Available: i%4 != 0})
+	}
+	if data.Len() > 61 {
+		return false
+	}
+
+	datas := NewRespMap(1)
+	datas["localhost"] = data
+	res := (&datas).ComputeMetrics([]Metric{Availability{}, CodeCount{}}, 4*time.Hour)
+	if len(res) != 1 || len(res[0].Metrics) != 2 {
+		return false
+	}
+	avail, ok := res[0].Metrics[0].Output.(MetricFloat)
+	codes, _ := res[0].Metrics[1].Output.(MetricMap)
+	return ok && avail == 75 && codes["200"] == MetricInt(180)
+}
+
+//TestCertificates tests the certificate monitoring logic. It starts a local HTTPS server with a self-signed certificate
+//which expires in two days, trusted through a CA file. It checks the server and calls the certificate hook, which should
+//warn about the expiry. Then it checks the server with a hostname the certificate is not valid for, and the hook should
+//report a validation failure.
+//If all theses conditions are met, it returns true ; false otherwise.
+func TestCertificates() bool {
+	//Self-signed certificate for 127.0.0.1
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return false
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "MicroMon test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(48 * time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return false
+	}
+	caFile, err := ioutil.TempFile("", "micromon")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	caFile.Close()
+
+	//Local HTTPS server
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(dummyResponse))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	conf := Config{CertThresholds: []int{30, 3}}
+	rec := make(recordNotifier, 10)
+	n := &notifiers{names: []string{"record"}, byName: map[string]Notifier{"record": rec}, queues: make(map[string]chan Alert)}
+	incidents := &IncidentHistory{}
+	hook := CertHook{&alerting{notifiers: n, incidents: incidents, silences: &Silences{}}}.GetHook(conf)
+	check := func(url string) string {
+		resp, _ := CheckWebsite(context.Background(), Website{URL: url, TLS: TLSConf{CAFile: caFile.Name()}}, 3*time.Second)
+		resp.Name = "localhost"
+		datas := NewRespMap(1)
+		datas["localhost"] = NewSafeData()
+		datas["localhost"].Add(resp)
+		return hook(datas.ComputeMetrics([]Metric{CertDaysRemaining{}}, 2*time.Minute))
+	}
+
+	//Certificate is valid but expires soon
+	if check(srv.URL) != "expiring" {
+		n.close()
+		return false
+	}
+	//Certificate is not valid for localhost, which is known without the failureReasons metric
+	if check(strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)) != "invalid" {
+		n.close()
+		return false
+	}
+	//Valid again
+	check(srv.URL)
+	n.close()
+
+	//Alerts are recorded as incidents and notified
+	close(rec)
+	states := make([]string, 0)
+	for a := range rec {
+		states = append(states, a.Rule+" "+a.State)
+	}
+	ongoing := incidents.Query(IncidentQuery{Ongoing: true})
+	return strings.Join(states, ", ") == "certificateExpiry firing, certificateInvalid firing, certificateInvalid resolved" &&
+		len(ongoing) == 1 && ongoing[0].Rule == "certificateExpiry"
+}
+
+//TestOverrides tests per-website settings. It loads a configuration in which a website inherits its timeout, availability
+//threshold and metrics from a template, which itself inherits from another one, while another website keeps global settings.
+//It checks inherited values, and that the alerting hook uses the threshold of each website on the same availability.
+//If all theses conditions are met, it returns true ; false otherwise.
+func TestOverrides() bool {
+	f, err := ioutil.TempFile("", "micromon")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`
+timeout: 3s
+availthreshold: 95
+metrics: [availability]
+templates:
+  base:
+    timeout: 10s
+    headers:
+      Accept: text/html
+  strict:
+    template: base
+    availthreshold: 99.9
+    metrics: [availability, averageTime]
+websites:
+  public:
+    url: http://localhost:8080
+    interval: 1s
+    template: strict
+    headers:
+      User-Agent: MicroMon
+  admin:
+    url: http://localhost:8080/admin
+    interval: 1s
+`)
+	f.Close()
+	conf, err := FetchConfig(f.Name())
+	if err != nil {
+		return false
+	}
+	public := conf.Websites["public"]
+	if public.Timeout != Duration(10*time.Second) || len(public.Headers) != 2 || len(GetSiteMetrics(conf).For("public")) != 2 || len(GetSiteMetrics(conf).For("admin")) != 1 {
+		return false
+	}
+
+	//Same availability : below the threshold of public website only
+	hook := AlertHook{}.GetHook(conf)
+	avail := []WebMetric{{Availability{}, MetricFloat(99)}}
+	if hook([]WebMetrics{{Timeframe: time.Minute, WebsiteName: "admin", Metrics: avail}}) != "" || hook([]WebMetrics{{Timeframe: time.Minute, WebsiteName: "public", Metrics: avail}}) != "unavailable" {
+		return false
+	}
+
+	//Without global hooks, the hooks of a website do not apply to the others
+	conf = Config{AvailThreshold: 50, Websites: map[string]Website{"a": {Hooks: []string{"alert"}}, "b": {}}}
+	incidents := &IncidentHistory{}
+	schedules, err := getSchedules(conf, incidents, &Silences{})
+	if err != nil {
+		return false
+	}
+	down := []WebMetric{{Availability{}, MetricFloat(0)}}
+	for _, h := range schedules[0].Hooks {
+		h([]WebMetrics{{WebsiteName: "a", Metrics: down}, {WebsiteName: "b", Metrics: down}})
+	}
+	closeSchedules(schedules, true)
+	alerted := incidents.Query(IncidentQuery{})
+	return len(alerted) == 1 && alerted[0].Website == "a"
+}
+
+//TestConfigErrors validates a configuration file with several known errors, and checks that they are all reported,
+//ordered by line, with the line of the faulty entry. Secrets which are not available must not make validation fail,
+//but must make loading fail once the configuration is fixed, until they are available.
+//If all theses conditions are met, it returns true ; false otherwise.
+func TestConfigErrors() bool {
+	write := func(content string) (string, error) {
+		f, err := ioutil.TempFile("", "micromon")
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		_, err = f.WriteString(content)
+		return f.Name(), err
+	}
+	os.Unsetenv("MICROMON_TEST_SECRET")
+	invalid, err := write(`timeout: 3s
+availthreshold: 150
+websites:
+  web:
+    url: http://localhost:8080
+    interval: -1s
+    headers:
+      Authorization: env:MICROMON_TEST_SECRET
+    unknown: true
+  job:
+    type: push
+    token: env:MICROMON_TEST_SECRET
+    interval: 1m
+  other:
+    type: gopher
+    interval: 1m
+notifiers:
+  chat:
+    type: pigeon
+`)
+	defer os.Remove(invalid)
+	if err != nil {
+		return false
+	}
+	_, err = ValidateConfig(invalid)
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		return false
+	}
+	want := []struct {
+		line int
+		path string
+	}{{2, "availthreshold"}, {6, "websites.web.interval"}, {9, ""}, {15, "websites.other.type"}, {18, "notifiers.chat"}}
+	if len(errs) != len(want) {
+		return false
+	}
+	for i, w := range want {
+		if errs[i].Line != w.line || errs[i].Path != w.path {
+			return false
+		}
+	}
+	if !strings.HasPrefix(errs[0].Error(), "line 2 : availthreshold : ") {
+		return false
+	}
+	if _, err := FetchConfig(invalid); err == nil || err.Error() != errs.Error() {
+		return false
+	}
+
+	//Once fixed, the configuration is valid, but cannot be loaded without its secrets
+	valid, err := write(`timeout: 3s
+availthreshold: 95
+websites:
+  web:
+    url: http://localhost:8080
+    interval: 1s
+    headers:
+      Authorization: env:MICROMON_TEST_SECRET
+  job:
+    type: push
+    token: env:MICROMON_TEST_SECRET
+    interval: 1m
+`)
+	defer os.Remove(valid)
+	if err != nil {
+		return false
+	}
+	if _, err := ValidateConfig(valid); err != nil {
+		return false
+	}
+	_, err = FetchConfig(valid)
+	if errs, ok = err.(ConfigErrors); !ok || len(errs) != 2 || errs[0].Line != 4 || errs[1].Line != 11 {
+		return false
+	}
+	os.Setenv("MICROMON_TEST_SECRET", "secret")
+	defer os.Unsetenv("MICROMON_TEST_SECRET")
+	conf, err := FetchConfig(valid)
+	return err == nil && conf.Websites["web"].Headers["Authorization"] == "secret" && conf.Websites["job"].Token == "secret"
+}
+
+//TestGroups tests group aggregates. Three websites labelled as a same service are checked every 10 seconds : the first one
+//is always up, the second one is down during the second period and the third one is always down.
+//It checks the time-weighted availability of the group in each mode, and that the group is found by its labels.
+//If all theses conditions are met, it returns true ; false otherwise.
+func TestGroups() bool {
+	now := time.Now().Add(-time.Minute)
+	labels := map[string]string{"service": "api"}
+	conf := Config{Websites: map[string]Website{"a": {Labels: labels}, "b": {Labels: labels}, "c": {Labels: labels}, "other": {}}}
+	datas := NewRespMap(3)
+	for _, name := range []string{"a", "b", "c"} {
+		datas[name] = NewSafeData()
+		for i := 0; i < 3; i++ {
+			up := name == "a" || (name == "b" && i != 1)
+			datas[name].Add(MetaResponse{Name: name, Labels: labels, Timestamp: now.Add(time.Duration(i) * 10 * time.Second), Available: up})
+		}
+	}
+
+	expected := map[string]MetricFloat{"all": 0, "any": 100, "quorum": 50}
+	for mode, avail := range expected {
+		conf.Groups = map[string]Group{"api": {Labels: labels, Mode: mode, Quorum: 2}}
+		res := (&datas).ComputeGroupMetrics(GetGroups(conf), time.Hour)
+		if len(res) != 1 || len(res[0].Members) != 3 || res[0].Metrics[0].Output != avail {
+			return false
+		}
+	}
+
+	//Time-weighted states of members : a is up, b is down during the second period, d never responded
+	cases := []struct {
+		mode    string
+		members []string
+		avail   MetricFloat
+	}{
+		{"all", []string{"a", "b"}, 50},
+		{"any", []string{"a", "b"}, 100},
+		{"any", []string{"b", "c"}, 50},
+		{"all", []string{"a", "d"}, 100},
+		{"all", []string{"b", "d"}, 50},
+	}
+	conf.Websites["d"] = Website{}
+	for _, c := range cases {
+		conf.Groups = map[string]Group{"g": {Websites: c.members, Mode: c.mode}}
+		res := (&datas).ComputeGroupMetrics(GetGroups(conf), time.Hour)
+		if len(res) != 1 || res[0].Metrics[0].Output != c.avail {
+			return false
+		}
+	}
+	return true
+}
+
+//TestLabels tests that labels of websites are attached to their responses, and that metrics carry the labels of the
+//newest response, e.g. after labels changed with the configuration. It also checks that XML reports escape names and labels.
+func TestLabels() bool {
+	srv := httptest.NewServer(http.HandlerFunc(dummyResponse))
+	defer srv.Close()
+	ch := make(chan MetaResponse, 1)
+	prod := map[string]string{"env": "prod"}
+	feedChan(context.Background(), Website{URL: srv.URL, Labels: prod}, "a", ch, time.Second)
+	resp := <-ch
+	if resp.Name != "a" || resp.Labels["env"] != "prod" {
+		return false
+	}
+
+	datas := NewRespMap(1)
+	datas["a"] = NewSafeData()
+	datas["a"].Add(resp)
+	datas["a"].Add(MetaResponse{Name: "a", Labels: map[string]string{"env": "staging"}, Timestamp: resp.Timestamp.Add(-time.Second)})
+	res := datas.ComputeMetrics([]Metric{Availability{}}, time.Minute)
+	if len(res) != 1 || res[0].Labels["env"] != "prod" {
+		return false
+	}
+
+	//Names, labels and members are escaped in XML reports, and timeframes are in minutes
+	report := XMLFormatter{}.Multiple(WebMetrics{Timeframe: 2 * time.Minute, WebsiteName: "R&D <api>", Labels: map[string]string{"team": "a&b"},
+		Members: []string{"<a>"}, Metrics: []WebMetric{{CodeCount{}, MetricMap{"<code>": MetricInt(1)}}}})
+	var parsed struct {
+		Group struct {
+			Name    string   `xml:"name"`
+			Members []string `xml:"members>member"`
+		} `xml:"group"`
+		Timeframe string `xml:"timeframe"`
+		Value     string `xml:"metric>value"`
+	}
+	if err := xml.Unmarshal([]byte(report), &parsed); err != nil {
+		return false
+	}
+	return parsed.Group.Name == "R&D <api>" && len(parsed.Group.Members) == 1 && parsed.Group.Members[0] == "<a>" && parsed.Timeframe == "2" && strings.Contains(parsed.Value, "<code>")
+}
+
+//TestRules tests alert rules. It checks that expressions are parsed into thresholds in milliseconds, that the 5xx selector
+//sums matching codes only, and that a rule goes pending, fires once its condition held long enough and resolves,
+//including when the website has no metrics anymore.
+//If all theses conditions are met, it returns true ; false otherwise.
+func TestRules() bool {
+	slow, err := Rule{Expr: "p95 > 800ms for 5m"}.compile()
+	if err != nil || slow.threshold != 800 || slow.For != Duration(5*time.Minute) || slow.Name != "p95 > 800ms for 5m" {
+		return false
+	}
+	if _, err := (Rule{Expr: "p95 >> 800ms"}).compile(); err == nil {
+		return false
+	}
+
+	fivexx, err := Rule{Expr: "codeCount[5xx] > 3 for 30s", Labels: map[string]string{"env": "prod"}}.compile()
+	if err != nil {
+		return false
+	}
+	engine := newRuleEngine([]alertRule{fivexx})
+	codes := func(name string, env string, errs int) WebMetrics {
+		out := MetricMap{"200": MetricInt(10), "500": MetricInt(errs / 2), "503": MetricInt(errs - errs/2)}
+		return WebMetrics{WebsiteName: name, Labels: map[string]string{"env": env}, Metrics: []WebMetric{{CodeCount{}, out}}}
+	}
+
+	now := time.Now()
+	steps := []struct {
+		metrics  []WebMetrics
+		after    time.Duration
+		expected []string
+	}{
+		//Condition holds but not for long enough, staging is not targeted
+		{[]WebMetrics{codes("a", "prod", 4), codes("b", "staging", 10)}, 0, []string{}},
+		{[]WebMetrics{codes("a", "prod", 4)}, 20 * time.Second, []string{}},
+		{[]WebMetrics{codes("a", "prod", 5)}, 30 * time.Second, []string{"firing"}},
+		{[]WebMetrics{codes("a", "prod", 6)}, 40 * time.Second, []string{}},
+		{[]WebMetrics{codes("a", "prod", 3)}, 50 * time.Second, []string{"resolved"}},
+		//Condition stops holding while pending : nothing fires
+		{[]WebMetrics{codes("a", "prod", 4)}, 60 * time.Second, []string{}},
+		{[]WebMetrics{codes("a", "prod", 0)}, 100 * time.Second, []string{}},
+		//Website removed while firing
+		{[]WebMetrics{codes("a", "prod", 4)}, 110 * time.Second, []string{}},
+		{[]WebMetrics{codes("a", "prod", 4)}, 140 * time.Second, []string{"firing"}},
+		{[]WebMetrics{}, 150 * time.Second, []string{"resolved"}},
+	}
+	for _, s := range steps {
+		alerts := engine.evaluate(s.metrics, now.Add(s.after))
+		if len(alerts) != len(s.expected) {
+			return false
+		}
+		for i, a := range alerts {
+			if a.State != s.expected[i] || a.Website != "a" || a.Severity != defaultRuleSeverity {
+				return false
+			}
+		}
+	}
+
+	//Raw data is kept as long as rule windows need it, unless its retention is set
+	conf := Config{Rules: []Rule{{Expr: "averageTime > 500", Window: MinuteDuration(3 * time.Hour)}}}
+	if GetRetention(conf).MaxAge != MinuteDuration(3*time.Hour) {
+		return false
+	}
+	conf.Retention.MaxAge = MinuteDuration(time.Hour)
+	v := &validator{}
+	v.rules(conf)
+	return len(v.errs) == 1 && v.errs[0].Path == "rules.0.window"
+}
+
+//TestNotifiers tests notification channels against local stand-ins : a webhook which fails once before accepting
+//the alert rendered with its template, an in-process SMTP sink and a shell command writing its environment and input to a file.
+//An alert is sent through the notifiers of a configuration, which are then closed to wait for deliveries.
+//If all theses conditions are met, it returns true ; false otherwise.
+func TestNotifiers() bool {
+	//Webhook failing the first attempt
+	bodies := make(chan string, 2)
+	attempts := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- r.Header.Get("X-Token") + " " + string(body)
+	}))
+	defer hook.Close()
+
+	//SMTP sink
+	sink, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return false
+	}
+	defer sink.Close()
+	mails := make(chan string, 1)
+	go serveSMTPSink(sink, mails)
+
+	dir, err := ioutil.TempDir("", "micromon-notify")
+	if err != nil {
+		return false
+	}
+	defer os.RemoveAll(dir)
+	out := dir + "/alert"
+
+	os.Setenv("MICROMON_TEST_TOKEN", "secret")
+	retries := 2
+	conf := Config{Notifiers: map[string]NotifierConf{
+		"hook": {Type: "webhook", URL: hook.URL, Template: `{"text": "{{.Rule}} on {{.Website}} is {{.State}}"}`,
+			Headers: map[string]string{"X-Token": "env:MICROMON_TEST_TOKEN"}, Retries: &retries, Backoff: Duration(10 * time.Millisecond)},
+		"mail": {Type: "smtp", Address: sink.Addr().String(), From: "micromon@localhost", To: []string{"ops@localhost"}},
+		"exec": {Type: "exec", Command: "sh", Args: []string{"-c", `echo "$MICROMON_STATE $MICROMON_LABEL_ENV" > ` + out + ` && cat >> ` + out}},
+	}}
+	n := getNotifiers(conf)
+	if len(n.names) != 3 {
+		return false
+	}
+	now := time.Now()
+	n.send(Alert{"slow", "critical", "api", map[string]string{"env": "prod"}, "firing", 950, now, now}, nil)
+	n.close()
+
+	select {
+	case body := <-bodies:
+		if body != `secret {"text": "slow on api is firing"}` || attempts != 2 {
+			return false
+		}
+	default:
+		return false
+	}
+	select {
+	case mail := <-mails:
+		if !strings.Contains(mail, "Subject: [MicroMon] [critical] slow on api is firing") || !strings.Contains(mail, "env = prod") {
+			return false
+		}
+	case <-time.After(time.Second):
+		return false
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil || !strings.HasPrefix(string(data), "firing prod\n{") || !strings.Contains(string(data), `"Website":"api"`) {
+		return false
+	}
+
+	//Closed notifiers drop alerts
+	n.send(Alert{"slow", "critical", "api", nil, "resolved", 100, now, now}, []string{"hook"})
+	if len(bodies) != 0 {
+		return false
+	}
+
+	//Retries of a webhook which is down do not delay closing beyond the drain timeout
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	n = getNotifiers(Config{Notifiers: map[string]NotifierConf{"down": {Type: "webhook", URL: down.URL, Backoff: Duration(time.Hour)}}})
+	n.send(Alert{"slow", "critical", "api", nil, "firing", 950, now, now}, nil)
+	start := time.Now()
+	n.close()
+	if time.Since(start) >= notifyDrainTimeout+time.Second {
+		return false
+	}
+
+	//Names cannot inject mail headers
+	mail, _ := GetNotifier(conf.Notifiers["mail"])
+	if mail.Notify(context.Background(), Alert{"slow", "critical", "api\r\nBcc: eve@localhost", nil, "firing", 950, now, now}) != nil {
+		return false
+	}
+	select {
+	case m := <-mails:
+		header := strings.SplitN(m, "\r\n\r\n", 2)[0]
+		if strings.Contains(header, "\r\nBcc:") || !strings.Contains(header, "Subject: [MicroMon] [critical] slow on api Bcc: eve@localhost is firing\r\n") {
+			return false
+		}
+	case <-time.After(time.Second):
+		return false
+	}
+
+	//A mail server which does not answer is hung up on once the timeout expires
+	mute, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return false
+	}
+	defer mute.Close()
+	hungUp := make(chan bool, 1)
+	go func() {
+		conn, err := mute.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		netErr, ok := err.(net.Error)
+		hungUp <- err != nil && !(ok && netErr.Timeout())
+	}()
+	mail, _ = GetNotifier(NotifierConf{Type: "smtp", Address: mute.Addr().String(), From: "micromon@localhost", To: []string{"ops@localhost"}, Timeout: Duration(200 * time.Millisecond)})
+	start = time.Now()
+	if mail.Notify(context.Background(), Alert{"slow", "critical", "api", nil, "firing", 950, now, now}) == nil || time.Since(start) > time.Second || !<-hungUp {
+		return false
+	}
+	_, err = GetNotifier(NotifierConf{Type: "pigeon"})
+	return err != nil
+}
+
+//serveSMTPSink accepts SMTP connections and sends the content of each received message on a channel.
+//It understands just enough of the protocol for net/smtp clients.
+func serveSMTPSink(l net.Listener, mails chan<- string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			conn.Write([]byte("220 localhost sink\r\n"))
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+				case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+					conn.Write([]byte("250 localhost\r\n"))
+				case cmd == "DATA":
+					conn.Write([]byte("354 go ahead\r\n"))
+					var mail strings.Builder
+					for {
+						line, err := r.ReadString('\n')
+						if err != nil {
+							return
+						}
+						if line == ".\r\n" {
+							break
+						}
+						mail.WriteString(line)
+					}
+					mails <- mail.String()
+					conn.Write([]byte("250 queued\r\n"))
+				case cmd == "QUIT":
+					conn.Write([]byte("221 bye\r\n"))
+					return
+				default:
+					conn.Write([]byte("250 ok\r\n"))
+				}
+			}
+		}(conn)
+	}
+}
+
+//recordNotifier is a Notifier which records alerts on a channel, for testing purposes.
+type recordNotifier chan Alert
+
+func (r recordNotifier) Notify(ctx context.Context, a Alert) error {
+	r <- a
+	return nil
+}
+
+//TestHysteresis tests availability alerts hysteresis. A website must be below the availability threshold, then above
+//the recovery threshold, for two evaluations in a row to change state, the website setting being merged with global ones.
+//Changing state three times within six evaluations makes it flapping, which suspends notifications until it is stable.
+//If all theses conditions are met, it returns true ; false otherwise.
+func TestHysteresis() bool {
+	conf := Config{
+		AvailThreshold: 50,
+		Hysteresis:     Hysteresis{RecoveryThreshold: 80, FlapWindow: 6, FlapChanges: 3},
+		Websites:       map[string]Website{"a": {Hysteresis: Hysteresis{Consecutive: 2}}},
+	}
+	rec := make(recordNotifier, 10)
+	n := &notifiers{names: []string{"record"}, byName: map[string]Notifier{"record": rec}, queues: make(map[string]chan Alert)}
+	hook := AlertHook{&alerting{notifiers: n, incidents: &IncidentHistory{}, silences: &Silences{}}}.GetHook(conf)
+
+	steps := []struct {
+		avail    MetricFloat
+		expected string
+	}{
+		{40, ""}, {40, "unavailable"},
+		//Not enough to recover
+		{60, ""}, {90, ""}, {90, "recovered"},
+		//Third change in the window
+		{10, ""}, {10, "flapping"},
+		//Stable for the whole window
+		{10, ""}, {10, ""}, {10, ""}, {10, ""}, {10, ""}, {10, ""},
+	}
+	for _, s := range steps {
+		res := hook([]WebMetrics{{WebsiteName: "a", Metrics: []WebMetric{{Availability{}, s.avail}}}})
+		if res != s.expected {
+			return false
+		}
+	}
+	n.close()
+
+	//Down, recovered, then down again once not flapping anymore
+	close(rec)
+	states := make([]string, 0)
+	for a := range rec {
+		states = append(states, a.State)
+	}
+	return strings.Join(states, " ") == "firing resolved firing"
+}
+
+//TestIncidents tests the incident history. Availability incidents of a website are recorded by the alert hook in a file,
+//with their duration on recovery. The history is reopened as MicroMon would do on restart : an ongoing incident is resumed
+//by a new hook, which ends it on recovery. It also checks that the history is bounded, queryable, that ongoing
+//incidents of removed websites are ended, and that the recovery of an incident ended meanwhile is logged without duration.
+//If all theses conditions are met, it returns true ; false otherwise.
+func TestIncidents() bool {
+	dir, err := ioutil.TempDir("", "micromon-incidents")
+	if err != nil {
+		return false
+	}
+	defer os.RemoveAll(dir)
+	conf := Config{
+		AvailThreshold: 50,
+		Websites:       map[string]Website{"a": {}, "b": {}},
+		Incidents:      IncidentsConf{Path: dir + "/incidents.json", MaxCount: 3},
+		Timeframes:     []Timeframe{{Name: "alerts", Span: MinuteDuration(time.Minute), Every: Duration(time.Second), Hooks: []string{"alert"}}},
+	}
+	avail := func(hook Hook, name string, v MetricFloat) string {
+		return hook([]WebMetrics{{WebsiteName: name, Metrics: []WebMetric{{Availability{}, v}}}})
+	}
+	open := func() (*IncidentHistory, Hook) {
+		h, err := OpenIncidentHistory(conf)
+		if err != nil {
+			return nil, nil
+		}
+		return h, AlertHook{&alerting{notifiers: &notifiers{}, incidents: h, silences: &Silences{}}}.GetHook(conf)
+	}
+
+	//Down then recovered
+	h, hook := open()
+	if h == nil || avail(hook, "a", 0) != "unavailable" || avail(hook, "a", 100) != "recovered" {
+		return false
+	}
+	res := h.Query(IncidentQuery{Website: "a"})
+	if len(res) != 1 || res[0].Ongoing() || res[0].Rule != "availability" {
+		return false
+	}
+
+	//Down, then restart and recovery
+	if avail(hook, "a", 0) != "unavailable" {
+		return false
+	}
+	h, hook = open()
+	if h == nil || len(h.Query(IncidentQuery{Ongoing: true})) != 1 || avail(hook, "a", 100) != "recovered" {
+		return false
+	}
+
+	//Bounded history, the oldest incidents are dropped
+	for i := 0; i < 2; i++ {
+		avail(hook, "b", 0)
+		avail(hook, "b", 100)
+	}
+	if len(h.Query(IncidentQuery{})) != 3 || len(h.Query(IncidentQuery{Website: "a"})) != 1 {
+		return false
+	}
+	if len(h.Query(IncidentQuery{Since: time.Now().Add(time.Hour)})) != 0 {
+		return false
+	}
+
+	//Website removed while down
+	avail(hook, "b", 0)
+	delete(conf.Websites, "b")
+	h.resolve(activeIncidents(conf), time.Now())
+	h, hook = open()
+	if h == nil || len(h.Query(IncidentQuery{Ongoing: true})) != 0 || len(h.Query(IncidentQuery{})) != 3 {
+		return false
+	}
+
+	//An incident ended meanwhile has no duration to log on recovery
+	avail(hook, "a", 0)
+	h.resolve(func(Incident) bool { return false }, time.Now())
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	recovered := avail(hook, "a", 100)
+	log.SetOutput(os.Stderr)
+	if recovered != "recovered" || !strings.Contains(logs.String(), "Website a recovered. Time") {
+		return false
+	}
+
+	//The reason of an unavailability is known without computing the failureReasons metric
+	datas := NewRespMap(1)
+	datas["a"] = NewSafeData()
+	for _, f := range []FailureReason{FailureTimeout, FailureTimeout, FailureRefused} {
+		datas["a"].Add(MetaResponse{Name: "a", Timestamp: time.Now(), Failure: f})
+	}
+	hook(datas.ComputeMetrics([]Metric{Availability{}}, time.Minute))
+	res = h.Query(IncidentQuery{Website: "a", Ongoing: true})
+	return len(res) == 1 && res[0].Reason == string(FailureTimeout)
+}
+
+//TestMaintenance tests maintenance windows and silences. It checks cron-style schedules, marks a response checked during
+//a window excluding availability, then checks that alerts are not notified during a window nor while silenced.
+func TestMaintenance() bool {
+	//Every Sunday at 3 AM for an hour
+	w, err := MaintenanceWindow{Name: "backups", Schedule: "0 3 * * 0", Duration: Duration(time.Hour), ExcludeAvailability: true}.compile()
+	if err != nil {
+		return false
+	}
+	sunday := time.Date(2026, 10, 18, 3, 30, 0, 0, time.Local)
+	if !w.active(sunday) || w.active(sunday.Add(time.Hour)) || w.active(sunday.Add(-24*time.Hour)) {
+		return false
+	}
+	if _, err := (MaintenanceWindow{Start: "2026-10-20 22:00", End: "2026-10-20 21:00"}).compile(); err == nil {
+		return false
+	}
+
+	//Responses checked during the window do not count in availability
+	windows := []*maintenance{w}
+	resp := []MetaResponse{{Name: "a", Timestamp: sunday, Code: 500}, {Name: "a", Timestamp: sunday.Add(-time.Hour), Code: 200, Available: true}}
+	for i := range resp {
+		markMaintenance(windows, &resp[i])
+	}
+	if resp[0].Maintenance == "" || !resp[0].ExcludedFromAvailability || resp[1].Maintenance != "" {
+		return false
+	}
+	if avail, ok := (Availability{}).Compute(resp).(MetricFloat); !ok || avail != 100 {
+		return false
+	}
+
+	//The unavailability is notified once the window is over
+	now := time.Now()
+	ongoing, _ := MaintenanceWindow{Name: "deploy", Start: now.Add(-time.Hour).Format(time.RFC3339), End: now.Add(time.Hour).Format(time.RFC3339)}.compile()
+	conf := Config{AvailThreshold: 50, Websites: map[string]Website{"a": {}}}
+	rec := make(recordNotifier, 10)
+	n := &notifiers{names: []string{"record"}, byName: map[string]Notifier{"record": rec}, queues: make(map[string]chan Alert)}
+	a := &alerting{notifiers: n, incidents: &IncidentHistory{}, maintenances: []*maintenance{ongoing}, silences: &Silences{}}
+	hook := AlertHook{a}.GetHook(conf)
+	down := []WebMetrics{{WebsiteName: "a", Metrics: []WebMetric{{Availability{}, MetricFloat(10)}}}}
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	for i := 0; i < 3; i++ {
+		hook(down)
+	}
+	log.SetOutput(os.Stderr)
+	//The suppression is logged once
+	if len(rec) != 0 || strings.Count(logs.String(), "suppressed by maintenance window") != 1 {
+		n.close()
+		return false
+	}
+	a.maintenances = nil
+	hook(down)
+	n.close()
+	if len(rec) != 1 {
+		return false
+	}
+
+	//Silences select alerts by website and rule, and can be expired
+	file, err := ioutil.TempFile("", "silences")
+	if err != nil {
+		return false
+	}
+	file.Close()
+	os.Remove(file.Name())
+	defer os.Remove(file.Name())
+	silences, err := OpenSilences(Config{SilencesPath: file.Name()})
+	if err != nil {
+		return false
+	}
+	s, err := silences.Add(Silence{Websites: []string{"a"}, Rules: []string{"availability"}, End: now.Add(time.Hour), Comment: "test"})
+	if err != nil {
+		return false
+	}
+	if _, ok := silences.match(Alert{Rule: "availability", Website: "a"}, time.Now()); !ok {
+		return false
+	}
+	if _, ok := silences.match(Alert{Rule: "latency", Website: "a"}, time.Now()); ok {
+		return false
+	}
+	//Silences changed by another process are seen
+	time.Sleep(10 * time.Millisecond)
+	other, err := OpenSilences(Config{SilencesPath: file.Name()})
+	if err != nil || len(other.List()) != 1 || other.Expire(s.ID) != nil {
+		return false
+	}
+	_, ok := silences.match(Alert{Rule: "availability", Website: "a"}, time.Now())
+	return !ok && len(silences.List()) == 0
+}
+
+//TestHeartbeats tests push websites. A website which does not ping is reported unavailable as soon as its interval
+//plus its grace period is over, and a ping delays the next deadline.
+func TestHeartbeats() bool {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return false
+	}
+	addr := l.Addr().String()
+	l.Close()
+	conf := Config{PushListen: addr, Websites: map[string]Website{
+		"job": {Type: "push", Token: "secret", Interval: Duration(300 * time.Millisecond), Grace: Duration(100 * time.Millisecond)},
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	ch := make(chan MetaResponse, 10)
+	start := time.Now()
+	if err := watchHeartbeats(ctx, conf, ch, &wg); err != nil {
+		cancel()
+		return false
+	}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	//Ping before the deadline, which is moved to 400ms after the ping
+	time.Sleep(250 * time.Millisecond)
+	resp, err := http.Get("http://" + addr + "/ping/secret")
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	pinged := time.Now()
+	select {
+	case m := <-ch:
+		if !m.Available {
+			return false
+		}
+	case <-time.After(time.Second):
+		return false
+	}
+	select {
+	case m := <-ch:
+		late := time.Since(pinged)
+		return !m.Available && m.Failure == FailureMissed && late >= 400*time.Millisecond && late < 600*time.Millisecond && time.Since(start) > 600*time.Millisecond
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+//TestHistogram tests latency histograms. Bucket bounds are parsed from the metric parameter and invalid ones are rejected,
+//response times are counted in their bucket, from responses or rollups, and histograms are rendered per bucket
+//by both formatters.
+//If all theses conditions are met, it returns true ; false otherwise.
+func TestHistogram() bool {
+	met, err := GetMetric("latencyHistogram:100,250,500,1000")
+	l, ok := met.(LatencyHistogram)
+	if err != nil || !ok || !reflect.DeepEqual(l.Bounds, []float64{100, 250, 500, 1000}) {
+		return false
+	}
+	if l, err := NewLatencyHistogram(""); err != nil || !reflect.DeepEqual(l.Bounds, defaultHistogramBounds) {
+		return false
+	}
+	for _, param := range []string{"100,50", "100,100", "0,100", "-5", "abc", "100,,200"} {
+		if _, err := GetMetric("latencyHistogram:" + param); err == nil {
+			return false
+		}
+	}
+
+	//Bounds are inclusive, unavailable checks are ignored
+	data := make([]MetaResponse, 0)
+	for _, ms := range []int{50, 100, 120, 600, 2000} {
+		data = append(data, MetaResponse{Available: true, RespDuration: time.Duration(ms) * time.Millisecond})
+	}
+	data = append(data, MetaResponse{Failure: FailureTimeout, RespDuration: 30 * time.Millisecond})
+	h, ok := l.Compute(data).(MetricHistogram)
+	if !ok || !reflect.DeepEqual(h.Counts, []int{2, 1, 0, 1, 1}) {
+		return false
+	}
+	total := 0
+	if r, ok := l.ComputeRollup(rollupOf(data)).(MetricHistogram); ok {
+		for _, c := range r.Counts {
+			total += c
+		}
+	}
+	if total != 5 {
+		return false
+	}
+	h.Observe(700, 2)
+	if h.Counts[3] != 3 {
+		return false
+	}
+
+	//Rendering, with a bar proportional to the count
+	if h.Format(true) != "[<=100 : 2, <=250 : 1, <=500 : 0, <=1000 : 3, >1000 : 1]" {
+		return false
+	}
+	wm := WebMetric{l, h}
+	lines := strings.Split(DefaultFormatter{}.Single(wm), "\n\t\t")
+	if len(lines) != 6 || lines[0] != l.Description()+" :" || !strings.HasSuffix(lines[4], strings.Repeat("#", histogramBarWidth)) {
+		return false
+	}
+	var parsed struct {
+		Name    string `xml:"name"`
+		Buckets []struct {
+			Le    string `xml:"le"`
+			Count int    `xml:"count"`
+		} `xml:"value>histogram>bucket"`
+	}
+	if err := xml.Unmarshal([]byte(XMLFormatter{}.Single(wm)), &parsed); err != nil || parsed.Name != "latencyHistogram" || len(parsed.Buckets) != 5 {
+		return false
+	}
+	return parsed.Buckets[3].Le == "1000" && parsed.Buckets[3].Count == 3 && parsed.Buckets[4].Le == "+Inf" && parsed.Buckets[4].Count == 1
+}
+
+//TestSketch tests quantiles estimated by a Sketch : their relative error is bounded, merged sketches estimate the same
+//quantiles as a single one, and response time metrics ignore unavailable checks.
+func TestSketch() bool {
+	all, low, high := Sketch{}, Sketch{}, Sketch{}
+	n := 10000
+	for i := 1; i <= n; i++ {
+		d := time.Duration(i) * time.Millisecond
+		all.Add(d)
+		if i%2 == 0 {
+			low.Add(d)
+		} else {
+			high.Add(d)
+		}
+	}
+	low.Merge(high)
+	for _, q := range []float64{0, 0.5, 0.9, 0.95, 0.99, 1} {
+		exact := float64(int(q*float64(n-1))+1) * float64(time.Millisecond)
+		if math.Abs(float64(all.Quantile(q))-exact) > sketchAccuracy*exact || low.Quantile(q) != all.Quantile(q) {
+			return false
+		}
+	}
+	if low.Count != all.Count {
+		return false
+	}
+
+	//Half of checks failed : response times are those of available checks
+	data := make([]MetaResponse, 0)
+	for i := 0; i < 10; i++ {
+		data = append(data, MetaResponse{Available: true, RespDuration: 100 * time.Millisecond}, MetaResponse{Failure: FailureTimeout})
+	}
+	r := rollupOf(data)
+	for _, res := range []Result{Percentile{50}.Compute(data), Percentile{50}.ComputeRollup(r), AvgRespTime{}.Compute(data), AvgRespTime{}.ComputeRollup(r)} {
+		if v, ok := res.(MetricFloat); !ok || math.Abs(float64(v)-100) > 1 {
+			return false
+		}
+	}
+	return true
+}
+
+//TestTransactions tests multi-step transactions. A token extracted by a first step authenticates a second one,
+//a step using an undefined variable or an invalid regular expression fails the transaction, and such variables are rejected by validation.
+func TestTransactions() bool {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/login":
+			w.Write([]byte(`{"token": "abc"}`))
+		case r.Header.Get("Authorization") != "Bearer abc":
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	login := Step{Name: "login", URL: server.URL + "/login", Extract: []Extraction{{Var: "token", JSON: "$.token"}}}
+	api := Step{Name: "api", URL: server.URL + "/api", Request: Request{Headers: map[string]string{"Authorization": "Bearer {{.token}}"}}}
+	meta, err := checkTransaction(context.Background(), Website{URL: server.URL, Steps: []Step{login, api}}, time.Second)
+	if err != nil || !meta.Available || len(meta.Steps) != 2 || meta.Code != 200 {
+		return false
+	}
+
+	//The token is not extracted anymore
+	login.Extract = nil
+	meta, err = checkTransaction(context.Background(), Website{URL: server.URL, Steps: []Step{login, api}}, time.Second)
+	if err != nil || meta.Available || meta.FailedStep != "api" || meta.Failure != FailureRequest || len(meta.Steps) != 2 {
+		return false
+	}
+
+	//Compiling a website does not change its configuration, and an invalid regular expression fails the step
+	website := Website{URL: server.URL, Steps: []Step{{Name: "login", URL: server.URL + "/login", Extract: []Extraction{{Var: "token", Regex: `"token": "(\w+)"`}}}, api}}
+	compiled, err := website.compile()
+	if err != nil || website.Steps[0].Extract[0].regex != nil || compiled.Steps[0].Extract[0].regex == nil {
+		return false
+	}
+	if meta, err = checkTransaction(context.Background(), compiled, time.Second); err != nil || !meta.Available {
+		return false
+	}
+	website.Steps[0].Extract[0].Regex = "("
+	meta, err = checkTransaction(context.Background(), website, time.Second)
+	if err != nil || meta.Available || meta.FailedStep != "login" || meta.Failure != FailureAssertion {
+		return false
+	}
+
+	//Variables must be extracted by previous steps
+	cases := []struct {
+		step  Step
+		known map[string]bool
+		valid bool
+	}{
+		{api, map[string]bool{"token": true}, true},
+		{api, map[string]bool{}, false},
+		{Step{URL: server.URL + "/{{if .id}}{{.id}}{{end}}"}, map[string]bool{"token": true}, false},
+		{Step{URL: server.URL, Request: Request{Body: `{"user": "{{.user}}"}`}}, map[string]bool{"user": true}, true},
+		{Step{URL: server.URL + "/{{.token"}, map[string]bool{"token": true}, false},
+	}
+	for _, c := range cases {
+		if (c.step.validate(c.known) == nil) != c.valid {
+			return false
+		}
+	}
+	return true
+}
+
+//TestTimings tests the breakdown of a check in phases : all phases of a successful HTTPS check are measured,
+//while a failed TLS handshake is reported as the failure of the check rather than as a TLS phase, and classified by its type.
+func TestTimings() bool {
+	srv := httptest.NewTLSServer(http.HandlerFunc(dummyResponse))
+	defer srv.Close()
+	caFile, err := ioutil.TempFile("", "micromon")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	caFile.Close()
+
+	resp, err := CheckWebsite(context.Background(), Website{URL: srv.URL, TLS: TLSConf{CAFile: caFile.Name()}}, 3*time.Second)
+	if err != nil || !resp.Available || resp.ConnectDuration <= 0 || resp.TLSDuration <= 0 || resp.RespDuration <= 0 {
+		return false
+	}
+	//Failures are classified by the type of their errors, not by their messages
+	reasons := []struct {
+		err    error
+		reason FailureReason
+	}{
+		{tls.RecordHeaderError{}, FailureTLS},
+		{tls.AlertError(40), FailureTLS},
+		{&tls.CertificateVerificationError{Err: errors.New("expired")}, FailureCertificate},
+		{handshakeError{errors.New("tls: server selected unsupported protocol version 300")}, FailureTLS},
+		{errors.New("tls: not typed"), FailureNetwork},
+	}
+	for _, r := range reasons {
+		if classifyError(r.err) != r.reason {
+			return false
+		}
+	}
+
+	//Unknown authority
+	resp, err = CheckWebsite(context.Background(), Website{URL: srv.URL}, 3*time.Second)
+	return err == nil && !resp.Available && resp.Failure == FailureCertificate && resp.TLSDuration == 0 &&
+		resp.ConnectDuration > 0 && strings.HasPrefix(resp.Error, "TLS handshake failed")
+}
+
+//TestReload tests reloading a running Monitor. A reload which removes a website and adds another must keep the history
+//and the ongoing incident of the unchanged website, stop watching the removed one and start watching the added one,
+//without waiting for notifications pending with the previous notifiers.
+//A reload with an invalid configuration, or which push endpoint cannot be served, must fail without changing the running one.
+//If all theses conditions are met, it returns true ; false otherwise.
+func TestReload() bool {
+	srv := httptest.NewServer(http.HandlerFunc(dummyResponse))
+	defer srv.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	site := Website{URL: srv.URL, Interval: Duration(50 * time.Millisecond)}
+	hourly := Timeframe{Name: "hourly", Span: MinuteDuration(time.Hour), Every: Duration(time.Hour), Hooks: []string{"alert"}, NoReport: true}
+	conf := Config{Timeout: Duration(time.Second), AvailThreshold: 50, Timeframes: []Timeframe{hourly},
+		Notifiers: map[string]NotifierConf{"down": {Type: "webhook", URL: down.URL, Backoff: Duration(time.Hour)}},
+		Websites:  map[string]Website{"kept": site, "removed": site}}
+	m, err := NewMonitor(conf)
+	if err != nil {
+		return false
+	}
+	m.incidents.record(Alert{"availability", "critical", "kept", nil, "firing", 0, time.Now(), time.Now()}, "")
+	done := make(chan error, 1)
+	go func() { done <- m.Run(context.Background()) }()
+	defer func() {
+		m.Stop()
+		<-done
+	}()
+	waitFor := func(cond func() bool) bool {
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			if cond() {
+				return true
+			}
+		}
+		return false
+	}
+	ongoing := func() bool {
+		return len(m.Incidents(IncidentQuery{Website: "kept", Rule: "availability", Ongoing: true})) == 1
+	}
+	kept := m.datas["kept"]
+	if !waitFor(func() bool { return kept.Len() >= 3 }) {
+		return false
+	}
+
+	//Replace a website with another one, while a notification is waiting for a retry
+	m.schedules[0].alerting.notifiers.send(Alert{"availability", "critical", "kept", nil, "firing", 0, time.Now(), time.Now()}, nil)
+	time.Sleep(100 * time.Millisecond)
+	before := kept.Len()
+	conf.Websites = map[string]Website{"kept": site, "added": site}
+	reloading := time.Now()
+	if m.Reload(conf) != nil || time.Since(reloading) > time.Second || m.datas["kept"] != kept || kept.Len() < before || !ongoing() {
+		return false
+	}
+	if _, ok := m.datas["removed"]; ok {
+		return false
+	}
+	if _, ok := m.watchers.cancels["removed"]; ok {
+		return false
+	}
+	added := m.datas["added"]
+	if added == nil || !waitFor(func() bool { return added.Len() > 0 }) {
+		return false
+	}
+
+	//An unknown format cannot be applied, which would otherwise end the incident of the website it removes
+	reported := hourly
+	reported.NoReport, reported.Format = false, "unknown"
+	invalid := Config{Timeout: conf.Timeout, AvailThreshold: conf.AvailThreshold, Timeframes: []Timeframe{reported},
+		Websites: map[string]Website{"added": site, "other": site}}
+	if m.Reload(invalid) == nil || !ongoing() || len(m.conf.Websites) != 2 || len(m.watchers.cancels) != 2 {
+		return false
+	}
+	if _, ok := m.datas["other"]; ok || m.datas["kept"] != kept {
+		return false
+	}
+	n := kept.Len()
+	if !waitFor(func() bool { return kept.Len() > n }) {
+		return false
+	}
+
+	//The push endpoint is only served once schedules are built, which must not end the incident of the website it removes
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return false
+	}
+	defer busy.Close()
+	push := Config{Timeout: conf.Timeout, AvailThreshold: conf.AvailThreshold, Timeframes: []Timeframe{hourly}, PushListen: busy.Addr().String(),
+		Websites: map[string]Website{"added": site, "job": {Type: "push", Token: "secret", Interval: Duration(time.Minute)}}}
+	return m.Reload(push) != nil && ongoing() && len(m.conf.Websites) == 2 && m.datas["kept"] == kept
+}
+
+//TestProbers tests the TCP and TLS probers against local servers. A TCP probe must succeed on a listening port and
+//fail with a refused connection once it is closed. A TLS probe must record the negotiated connection and the certificate
+//chain, whether the certificate is trusted or not. Unknown website types and invalid addresses must be rejected.
+//If all theses conditions are met, it returns true ; false otherwise.
+func TestProbers() bool {
+	if _, err := GetProber("gopher"); err == nil || err.Error() != "gopher is not a known website type" {
+		return false
+	}
+	if _, err := (TCPProber{}).Probe(context.Background(), Website{URL: "tcp://localhost"}, time.Second); err == nil {
+		return false
+	}
+
+	//TCP connection to a listening port, then to a closed one
+	srv := httptest.NewServer(http.HandlerFunc(dummyResponse))
+	addr := srv.Listener.Addr().String()
+	prober, _ := GetProber("tcp")
+	m, err := prober.Probe(context.Background(), Website{Type: "tcp", URL: "tcp://" + addr}, time.Second)
+	if err != nil || !m.Available || m.RespDuration != m.ConnectDuration || m.Timestamp.IsZero() {
+		srv.Close()
+		return false
+	}
+	srv.Close()
+	m, err = prober.Probe(context.Background(), Website{Type: "tcp", URL: addr}, time.Second)
+	if err != nil || m.Available || m.Failure != FailureRefused {
+		return false
+	}
+
+	//TLS handshake with a certificate trusted thanks to a CA file, then with the system roots only
+	tlsSrv := httptest.NewTLSServer(http.HandlerFunc(dummyResponse))
+	defer tlsSrv.Close()
+	caFile, err := ioutil.TempFile("", "micromon")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: tlsSrv.Certificate().Raw})
+	caFile.Close()
+	prober, _ = GetProber("tls")
+	website := Website{Type: "tls", URL: "tls://" + tlsSrv.Listener.Addr().String(), TLS: TLSConf{CAFile: caFile.Name()}}
+	m, err = prober.Probe(context.Background(), website, time.Second)
+	if err != nil || !m.Available || m.TLS == nil || m.RespDuration != m.TLSDuration || m.TLSDuration <= 0 {
+		return false
+	}
+	if !strings.HasPrefix(m.TLS.Version, "TLS 1.") || m.TLS.CipherSuite == "" || len(m.TLS.Chain) != 1 || m.TLS.VerifyError != "" {
+		return false
+	}
+	if !m.TLS.Chain[0].NotAfter.Equal(tlsSrv.Certificate().NotAfter) {
+		return false
+	}
+	website.TLS = TLSConf{}
+	m, err = prober.Probe(context.Background(), website, time.Second)
+	return err == nil && !m.Available && m.Failure == FailureCertificate && m.TLS != nil && len(m.TLS.Chain) == 1 && m.TLS.VerifyError != ""
+}
+
+//TestRequests tests the customization of requests : method, query parameters, headers, Host override, body, basic and
+//bearer authentication must be sent as configured. It also tests resolving secrets from environment variables and files.
+//If all theses conditions are met, it returns true ; false otherwise.
+func TestRequests() bool {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- string(body)
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		name    string
+		request Request
+		check   func(r *http.Request, body string) bool
+	}{
+		{"default", Request{}, func(r *http.Request, body string) bool {
+			return r.Method == "GET" && r.URL.RawQuery == "keep=1" && body == "" && r.Header.Get("Authorization") == ""
+		}},
+		{"method and body", Request{Method: "POST", Body: `{"ping":true}`}, func(r *http.Request, body string) bool {
+			return r.Method == "POST" && body == `{"ping":true}`
+		}},
+		{"query", Request{Query: map[string]string{"q": "a b"}}, func(r *http.Request, body string) bool {
+			return r.URL.Query().Get("keep") == "1" && r.URL.Query().Get("q") == "a b"
+		}},
+		{"headers", Request{Headers: map[string]string{"X-Test": "1", "host": "example.com"}}, func(r *http.Request, body string) bool {
+			return r.Header.Get("X-Test") == "1" && r.Host == "example.com"
+		}},
+		{"basic auth", Request{BasicAuth: &BasicAuth{"user", "pass"}}, func(r *http.Request, body string) bool {
+			user, pass, ok := r.BasicAuth()
+			return ok && user == "user" && pass == "pass"
+		}},
+		{"bearer", Request{BearerToken: "token"}, func(r *http.Request, body string) bool {
+			return r.Header.Get("Authorization") == "Bearer token"
+		}},
+	}
+	for _, c := range cases {
+		m, err := CheckWebsite(context.Background(), Website{URL: srv.URL + "/?keep=1", Request: c.request}, time.Second)
+		if err != nil || !m.Available {
+			return false
+		}
+		if !c.check(<-received, <-bodies) {
+			return false
+		}
+	}
+
+	//Secrets
+	secret, err := ioutil.TempFile("", "micromon")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(secret.Name())
+	secret.WriteString("from file\n")
+	secret.Close()
+	os.Setenv("MICROMON_TEST_SECRET", "from env")
+	defer os.Unsetenv("MICROMON_TEST_SECRET")
+	os.Unsetenv("MICROMON_TEST_MISSING")
+	secrets := []struct {
+		value string
+		want  string
+		fails bool
+	}{
+		{"plain", "plain", false},
+		{"env:MICROMON_TEST_SECRET", "from env", false},
+		{"env:MICROMON_TEST_MISSING", "", true},
+		{"file:" + secret.Name(), "from file", false},
+		{"file:" + secret.Name() + ".missing", "", true},
+	}
+	for _, s := range secrets {
+		if v, err := resolveSecret(s.value); (err != nil) != s.fails || v != s.want {
+			return false
+		}
+	}
+	r, err := resolveSecrets(Request{Headers: map[string]string{"X-Token": "env:MICROMON_TEST_SECRET"}, BasicAuth: &BasicAuth{"user", "file:" + secret.Name()}})
+	if err != nil || r.Headers["X-Token"] != "from env" || r.BasicAuth.Password != "from file" {
+		return false
+	}
+	_, err = resolveSecrets(Request{BearerToken: "env:MICROMON_TEST_MISSING"})
+	return err != nil && checkSecret("env:") != nil && checkSecret("env:MICROMON_TEST_MISSING") == nil
+}
+
+//TestAssertions tests response assertions : status codes, classes and ranges, body content, headers, JSON paths,
+//body size and response time. A website which response fails an assertion must be unavailable.
+//If all theses conditions are met, it returns true ; false otherwise.
+func TestAssertions() bool {
+	statuses := []struct {
+		rule  string
+		code  int
+		match bool
+	}{
+		{"200", 200, true},
+		{"200", 201, false},
+		{"2xx", 204, true},
+		{"2XX", 301, false},
+		{"200-399", 302, true},
+		{"200-399", 404, false},
+		{" 500 - 599 ", 503, true},
+	}
+	for _, s := range statuses {
+		if matchStatus([]string{s.rule}, s.code) != s.match {
+			return false
+		}
+	}
+	for _, rule := range []string{"abc", "2xy", "399-200", "200-"} {
+		if (Assertions{Status: []string{rule}}).validate() == nil {
+			return false
+		}
+	}
+	if (Assertions{BodyMatches: []string{"("}}).validate() == nil || (Assertions{Status: []string{"2xx", "304"}}).validate() != nil {
+		return false
+	}
+
+	resp := &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": []string{"application/json"}}}
+	body := []byte(`{"status":"ok","items":[{"id":7}]}`)
+	meta := MetaResponse{RespDuration: 150 * time.Millisecond}
+	cases := []struct {
+		name       string
+		assertions Assertions
+		failed     int
+	}{
+		{"none", Assertions{}, 0},
+		{"status", Assertions{Status: []string{"2xx"}}, 0},
+		{"wrong status", Assertions{Status: []string{"300-399", "404"}}, 1},
+		{"contains", Assertions{BodyContains: []string{`"ok"`, "items"}}, 0},
+		{"does not contain", Assertions{BodyContains: []string{"error"}}, 1},
+		{"not contains", Assertions{BodyNotContains: []string{"error", "ok"}}, 1},
+		{"matches", Assertions{BodyMatches: []string{`"id":\d+`}, BodyNotMatches: []string{`"id":"`}}, 0},
+		{"json", Assertions{JSON: map[string]string{"$.status": "ok", "$.items[0].id": "7"}}, 0},
+		{"wrong json", Assertions{JSON: map[string]string{"$.status": "down", "$.items[1].id": "7"}}, 2},
+		{"headers", Assertions{Headers: map[string]string{"content-type": "application/json", "X-Missing": ""}}, 1},
+		{"fast enough", Assertions{MaxResponseTime: MillisecondDuration(200 * time.Millisecond)}, 0},
+		{"too slow", Assertions{MaxResponseTime: MillisecondDuration(100 * time.Millisecond)}, 1},
+		{"too big", Assertions{MaxBodySize: 10, BodyContains: []string{"error"}}, 1},
+	}
+	for _, c := range cases {
+		if failed := c.assertions.check(resp, body, meta); len(failed) != c.failed {
+			return false
+		}
+	}
+
+	//Compiled assertions give the same results, and an invalid regular expression is a failure rather than a panic
+	for _, c := range cases {
+		compiled, err := c.assertions.compile()
+		if err != nil || len(compiled.check(resp, body, meta)) != c.failed {
+			return false
+		}
+	}
+	if len((Assertions{BodyMatches: []string{"("}}).check(resp, body, meta)) != 1 {
+		return false
+	}
+
+	//End to end : a failed assertion makes the website unavailable
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer srv.Close()
+	m, err := CheckWebsite(context.Background(), Website{URL: srv.URL, Assertions: Assertions{BodyContains: []string{`"ok"`}}}, time.Second)
+	if err != nil || !m.Available {
+		return false
+	}
+	m, err = CheckWebsite(context.Background(), Website{URL: srv.URL, Assertions: Assertions{Status: []string{"3xx"}, MaxBodySize: 5}}, time.Second)
+	return err == nil && !m.Available && m.Failure == FailureAssertion && len(m.FailedAssertions) == 2
+}
+
+//TestRing tests how responses are kept. The ring buffer must keep responses ordered, even when they come out of order
+//or when it wraps around, select windows by timestamp, and retention must drop the oldest responses.
+//If all theses conditions are met, it returns true ; false otherwise.
+func TestRing() bool {
+	start := time.Now().Add(-time.Hour)
+	at := func(i int) time.Time { return start.Add(time.Duration(i) * time.Second) }
+
+	//Out of order pushes, pops and wrap around
+	r := ring{}
+	for _, i := range []int{0, 2, 1, 5, 3, 4} {
+		r.push(MetaResponse{Timestamp: at(i)})
+	}
+	for i := 6; i < 16; i++ {
+		r.push(MetaResponse{Timestamp: at(i)})
+	}
+	for i := 0; i < 10; i++ {
+		if !r.pop().Timestamp.Equal(at(i)) {
+			return false
+		}
+	}
+	for i := 21; i >= 16; i-- {
+		r.push(MetaResponse{Timestamp: at(i)})
+	}
+	if r.len() != 12 || len(r.buf) != 16 || r.head != 10 {
+		return false
+	}
+	for i := 0; i < r.len(); i++ {
+		if !r.at(i).Timestamp.Equal(at(10 + i)) {
+			return false
+		}
+	}
+	if len(r.since(at(16))) != 6 || len(r.since(at(0))) != 12 || len(r.since(at(22))) != 0 {
+		return false
+	}
+
+	//Retention by count and by age
+	bySamples := NewBoundedSafeData(Retention{MaxSamples: 5})
+	byAge := NewBoundedSafeData(Retention{MaxAge: MinuteDuration(time.Minute)})
+	for i := 0; i < 8; i++ {
+		bySamples.Add(MetaResponse{Timestamp: time.Now()})
+	}
+	byAge.Add(MetaResponse{Timestamp: time.Now().Add(-2 * time.Minute)})
+	byAge.Add(MetaResponse{Timestamp: time.Now()})
+	if bySamples.Len() != 5 || byAge.Len() != 1 {
+		return false
+	}
+
+	//Copies of all responses, ordered
+	data := NewSafeData()
+	for _, i := range []int{2, 0, 1} {
+		data.Add(MetaResponse{Timestamp: at(i)})
+	}
+	all := data.Datas()
+	all[0].Code = 500
+	return len(all) == 3 && all[0].Timestamp.Equal(at(0)) && all[2].Timestamp.Equal(at(2)) && data.Datas()[0].Code == 0
+}
+
+//TestWindows tests metrics of timeframes : they must only be computed over the responses each timeframe contains,
+//and websites without responses in a timeframe are not reported.
+//If all theses conditions are met, it returns true ; false otherwise.
+func TestWindows() bool {
+	//Metrics of a short and of a long timeframe
+	now := time.Now()
+	datas := NewRespMap(1)
+	datas["localhost"] = NewSafeData()
+	for _, m := range []MetaResponse{
+		{Timestamp: now.Add(-5 * time.Minute), Available: true, Code: 200, RespDuration: 50 * time.Millisecond},
+		{Timestamp: now.Add(-90 * time.Second), Available: true, Code: 200, RespDuration: 100 * time.Millisecond},
+		{Timestamp: now.Add(-60 * time.Second), Available: true, Code: 200, RespDuration: 300 * time.Millisecond},
+		{Timestamp: now.Add(-30 * time.Second), Code: 500, RespDuration: time.Second},
+	} {
+		datas["localhost"].Add(m)
+	}
+	metrics := []Metric{Availability{}, AvgRespTime{}, MaxRespTime{}, CodeCount{}}
+	cases := []struct {
+		span time.Duration
+		want []Result
+	}{
+		{2 * time.Minute, []Result{MetricFloat(float64(2) / float64(3) * 100), MetricFloat(200), MetricFloat(300), MetricMap{"200": MetricInt(2), "500": MetricInt(1)}}},
+		{10 * time.Minute, []Result{MetricFloat(75), MetricFloat(150), MetricFloat(300), MetricMap{"200": MetricInt(3), "500": MetricInt(1)}}},
+	}
+	for _, c := range cases {
+		res := datas.ComputeMetrics(metrics, c.span)
+		if len(res) != 1 || len(res[0].Metrics) != len(c.want) {
+			return false
+		}
+		for i, m := range res[0].Metrics {
+			if !reflect.DeepEqual(m.Output, c.want[i]) {
+				return false
+			}
+		}
+	}
+	return len(datas.ComputeMetrics(metrics, 10*time.Second)) == 0
+}
+
+//TestStop tests stopping a Monitor, either with Stop or with its context, while a check is in flight.
+//Run must return promptly without error, the aborted check must not be recorded, and the stopped Monitor can
+//neither be reloaded nor run again. A Monitor which is not running cannot be reloaded either.
+//If all theses conditions are met, it returns true ; false otherwise.
+func TestStop() bool {
+	inflight := make(chan struct{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case inflight <- struct{}{}:
+		default:
+		}
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	conf := Config{Timeout: Duration(5 * time.Second), Timeframes: []Timeframe{{Name: "t", Span: MinuteDuration(time.Minute), Every: Duration(time.Hour), NoReport: true}},
+		Websites: map[string]Website{"slow": {URL: srv.URL, Interval: Duration(100 * time.Millisecond)}}}
+
+	cases := []struct {
+		name string
+		stop func(m *Monitor, cancel context.CancelFunc)
+	}{
+		{"Stop", func(m *Monitor, cancel context.CancelFunc) { m.Stop() }},
+		{"context", func(m *Monitor, cancel context.CancelFunc) { cancel() }},
+	}
+	for _, c := range cases {
+		m, err := NewMonitor(conf)
+		if err != nil {
+			return false
+		}
+		if m.Reload(conf) == nil {
+			return false
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- m.Run(ctx) }()
+		select {
+		case <-inflight:
+		case <-time.After(2 * time.Second):
+			cancel()
+			return false
+		}
+		stopped := time.Now()
+		c.stop(m, cancel)
+		select {
+		case err := <-done:
+			if err != nil || time.Since(stopped) > time.Second {
+				cancel()
+				return false
+			}
+		case <-time.After(2 * time.Second):
+			cancel()
+			return false
+		}
+		cancel()
+		if m.datas["slow"].Len() != 0 || m.Reload(conf) == nil || m.Run(context.Background()) == nil {
+			return false
+		}
+		//Stopping again is harmless
+		m.Stop()
+	}
+	return true
+}
+
+//TestTimeframes tests timeframes. Without timeframes in the configuration, the last 2 and 10 minutes are computed every
+//10 seconds and the last hour every minute, hooks only applying to the shortest one. Timeframes with a non-positive span
+//or period are rejected, as well as alerting hooks used by several timeframes. Each timeframe has its own hooks and reporter.
+//If all theses conditions are met, it returns true ; false otherwise.
+func TestTimeframes() bool {
+	defaults := GetTimeframes(Config{Hooks: []string{"alert"}, Websites: map[string]Website{"a": {Hooks: []string{"cert"}}}})
+	want := []Timeframe{
+		{Name: "2m", Span: MinuteDuration(2 * time.Minute), Every: Duration(10 * time.Second), Hooks: []string{"alert", "cert"}},
+		{Name: "10m", Span: MinuteDuration(10 * time.Minute), Every: Duration(10 * time.Second)},
+		{Name: "1h", Span: MinuteDuration(time.Hour), Every: Duration(time.Minute)},
+	}
+	if !reflect.DeepEqual(defaults, want) {
+		return false
+	}
+
+	//Invalid timeframes
+	conf := Config{Timeout: Duration(time.Second), Timeframes: []Timeframe{
+		{Name: "alerts", Span: MinuteDuration(time.Minute), Every: Duration(time.Second), Hooks: []string{"alert"}},
+		{Name: "nospan", Every: Duration(time.Second)},
+		{Name: "noperiod", Span: MinuteDuration(time.Minute), Every: Duration(-time.Second), Hooks: []string{"alert", "cert"}},
+	}}
+	if tfs := GetTimeframes(conf); len(tfs) != 1 || tfs[0].Name != "alerts" {
+		return false
+	}
+	v := &validator{}
+	v.config(conf)
+	paths := make([]string, 0)
+	for _, e := range v.errs {
+		paths = append(paths, e.Path)
+	}
+	if !reflect.DeepEqual(paths, []string{"timeframes.1.span", "timeframes.2.hooks", "timeframes.2.every"}) {
+		return false
+	}
+
+	//Hooks and reporter of each timeframe
+	out, err := ioutil.TempFile("", "micromon")
+	if err != nil {
+		return false
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+	conf.Timeframes = []Timeframe{
+		{Name: "alerts", Span: MinuteDuration(time.Minute), Every: Duration(time.Second), Hooks: []string{"alert"}, NoReport: true},
+		{Name: "report", Span: MinuteDuration(time.Minute), Every: Duration(50 * time.Millisecond), Output: out.Name()},
+	}
+	schedules, err := getSchedules(conf, &IncidentHistory{}, &Silences{})
+	if err != nil || len(schedules) != 2 {
+		return false
+	}
+	if schedules[0].Reporter != nil || len(schedules[0].Hooks) != 1 || schedules[1].Reporter == nil || len(schedules[1].Hooks) != 0 {
+		return false
+	}
+	datas := NewRespMap(1)
+	datas["localhost"] = NewSafeData()
+	datas["localhost"].Add(MetaResponse{Name: "localhost", Timestamp: time.Now(), Available: true, Code: 200})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	schedules[1].Run(ctx, &datas, SiteMetrics{Default: []Metric{Availability{}}})
+	closeSchedules(schedules, true)
+	report, err := ioutil.ReadFile(out.Name())
+	return err == nil && strings.Contains(string(report), "localhost") && strings.Contains(string(report), "Availability")
+}
+
+//TestDurations tests durations of the configuration file : duration strings are accepted whatever the field, while integers
+//keep their historical unit, seconds, minutes or milliseconds. Other values are rejected, and so are negative durations
+//where a positive one is expected.
+//If all theses conditions are met, it returns true ; false otherwise.
+func TestDurations() bool {
+	type durations struct {
+		D  Duration
+		M  MinuteDuration
+		Ms MillisecondDuration
+	}
+	cases := []struct {
+		yaml  string
+		want  durations
+		fails bool
+	}{
+		{"d: 500ms", durations{D: Duration(500 * time.Millisecond)}, false},
+		{"d: 2m", durations{D: Duration(2 * time.Minute)}, false},
+		{"d: 30", durations{D: Duration(30 * time.Second)}, false},
+		{"m: 10", durations{M: MinuteDuration(10 * time.Minute)}, false},
+		{"m: 90s", durations{M: MinuteDuration(90 * time.Second)}, false},
+		{"ms: 250", durations{Ms: MillisecondDuration(250 * time.Millisecond)}, false},
+		{"ms: 1s", durations{Ms: MillisecondDuration(time.Second)}, false},
+		{"d: -1s", durations{D: Duration(-time.Second)}, false},
+		{"d: soon", durations{}, true},
+		{"d: 1.5", durations{}, true},
+		{"m: [1]", durations{}, true},
+		{"ms: 10 parsecs", durations{}, true},
+	}
+	for _, c := range cases {
+		var d durations
+		if err := yaml.UnmarshalStrict([]byte(c.yaml), &d); (err != nil) != c.fails || (!c.fails && d != c.want) {
+			return false
+		}
+	}
+
+	//Negative durations are rejected by validation
+	v := &validator{}
+	v.config(Config{DefaultInterval: Duration(-time.Second), Timeout: Duration(-5 * time.Second), AvailThreshold: 50})
+	if len(v.errs) != 2 || v.errs[0].Path != "defaultinterval" || v.errs[1].Path != "timeout" {
+		return false
+	}
+	return defaultFsyncInterval == Duration(time.Second) && defaultRollupRawAge == MinuteDuration(24*time.Hour)
+}
@@ -0,0 +1,279 @@
+package micromon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"regexp"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+//Step is an HTTP request of a multi-step transaction, e.g. login, then fetch a token, then call an API.
+//URL, header values and body are templates in which variables extracted by previous steps can be used, e.g. "Bearer {{.token}}".
+//Assertions are evaluated as for a single request, and Extract defines variables to extract from the response.
+type Step struct {
+	Name       string
+	URL        string
+	Request    `yaml:",inline"`
+	Assertions Assertions
+	Extract    []Extraction
+}
+
+//Extraction defines how to extract a variable from a step response : with a JSON path in the body, with a regular
+//expression on the body (first group if any, whole match otherwise) or from a header. Only one source must be set.
+type Extraction struct {
+	Var    string
+	JSON   string
+	Regex  string
+	Header string
+	regex  *regexp.Regexp
+}
+
+//StepResult holds the outcome of a transaction step. Duration is the total duration of the step,
+//RespDuration is its server processing time.
+type StepResult struct {
+	Name         string
+	Code         int
+	Duration     time.Duration
+	RespDuration time.Duration
+	Available    bool
+	Error        string
+}
+
+//name returns the name of the i-th step, or a default one.
+func (s Step) name(i int) string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return fmt.Sprintf("step %d", i+1)
+}
+
+//validate checks that templates, assertions and extractions of a step are well-formed,
+//and that templates only use known variables, i.e. variables extracted by previous steps.
+func (s Step) validate(known map[string]bool) error {
+	texts := []string{s.URL, s.Body}
+	for _, v := range s.Headers {
+		texts = append(texts, v)
+	}
+	for _, text := range texts {
+		t, err := template.New("").Parse(text)
+		if err != nil {
+			return err
+		}
+		used := make(map[string]bool)
+		if t.Tree != nil {
+			templateVars(t.Tree.Root, used)
+		}
+		for v := range used {
+			if !known[v] {
+				return fmt.Errorf("variable %s is not extracted by a previous step", v)
+			}
+		}
+	}
+	for _, e := range s.Extract {
+		if e.Var == "" {
+			return fmt.Errorf("extraction without variable name")
+		}
+		if boolToInt(e.JSON != "")+boolToInt(e.Regex != "")+boolToInt(e.Header != "") != 1 {
+			return fmt.Errorf("variable %s must be extracted from exactly one of json, regex or header", e.Var)
+		}
+		if _, err := regexp.Compile(e.Regex); err != nil {
+			return err
+		}
+		if _, err := parseJSONPath(e.JSON); e.JSON != "" && err != nil {
+			return err
+		}
+	}
+	return s.Assertions.validate()
+}
+
+//compile returns the Step with the regular expressions of its assertions and extractions compiled.
+//Extractions are copied, so that the Step it is called on is left untouched.
+func (s Step) compile() (Step, error) {
+	var err error
+	if s.Assertions, err = s.Assertions.compile(); err != nil {
+		return s, err
+	}
+	s.Extract = append([]Extraction{}, s.Extract...)
+	for i, e := range s.Extract {
+		if e.Regex == "" {
+			continue
+		}
+		if s.Extract[i].regex, err = regexp.Compile(e.Regex); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+//templateVars collects the variables used by a template node, e.g. token for "{{.token}}".
+//Bodies of range and with actions are skipped, as dot is not the variables there.
+func templateVars(node parse.Node, vars map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n != nil {
+			for _, c := range n.Nodes {
+				templateVars(c, vars)
+			}
+		}
+	case *parse.ActionNode:
+		templateVars(n.Pipe, vars)
+	case *parse.PipeNode:
+		if n != nil {
+			for _, c := range n.Cmds {
+				templateVars(c, vars)
+			}
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			templateVars(a, vars)
+		}
+	case *parse.FieldNode:
+		vars[n.Ident[0]] = true
+	case *parse.IfNode:
+		templateVars(n.Pipe, vars)
+		templateVars(n.List, vars)
+		templateVars(n.ElseList, vars)
+	case *parse.RangeNode:
+		templateVars(n.Pipe, vars)
+		templateVars(n.ElseList, vars)
+	case *parse.WithNode:
+		templateVars(n.Pipe, vars)
+		templateVars(n.ElseList, vars)
+	case *parse.TemplateNode:
+		templateVars(n.Pipe, vars)
+	}
+}
+
+//website returns the Website to check for a step, once variables have been substituted in templates.
+//The body is read if it is needed by extractions.
+func (s Step) website(parent Website, vars map[string]string) (Website, error) {
+	headers := make(map[string]string, len(s.Headers))
+	for k, v := range s.Headers {
+		val, err := render(v, vars)
+		if err != nil {
+			return Website{}, err
+		}
+		headers[k] = val
+	}
+	s.Headers = headers
+	var err error
+	if s.URL, err = render(s.URL, vars); err != nil {
+		return Website{}, err
+	}
+	if s.Body, err = render(s.Body, vars); err != nil {
+		return Website{}, err
+	}
+	return Website{URL: s.URL, Request: s.Request, Assertions: s.Assertions, TLS: parent.TLS, ReadBody: len(s.Extract) > 0}, nil
+}
+
+//render executes a template with variables. Using an undefined variable is an error.
+func render(text string, vars map[string]string) (string, error) {
+	t, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = t.Execute(&buf, vars)
+	return buf.String(), err
+}
+
+//extract returns the value of the variable from a response and its body.
+func (e Extraction) extract(resp *http.Response, body []byte) (string, error) {
+	switch {
+	case e.Header != "":
+		if v := resp.Header.Get(e.Header); v != "" {
+			return v, nil
+		}
+		return "", fmt.Errorf("header %s is missing", e.Header)
+	case e.JSON != "":
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return "", fmt.Errorf("body is not valid JSON")
+		}
+		return evalJSONPath(doc, e.JSON)
+	}
+	re := e.regex
+	if re == nil {
+		var err error
+		if re, err = regexp.Compile(e.Regex); err != nil {
+			return "", err
+		}
+	}
+	m := re.FindSubmatch(body)
+	if m == nil {
+		return "", fmt.Errorf("body does not match %q", e.Regex)
+	}
+	return string(m[len(m)-1]), nil
+}
+
+//checkTransaction performs the steps of a Website in order, with a shared cookie jar, and produces a single MetaResponse.
+//Durations of the MetaResponse are the sums of the steps durations. The transaction stops at the first failing step,
+//which is recorded along with the reason of its failure. A step which request cannot be built, e.g. because it uses
+//an undefined variable, fails as well.
+func checkTransaction(ctx context.Context, website Website, timeout time.Duration) (MetaResponse, error) {
+	meta := MetaResponse{URL: website.URL, Available: true}
+	jar, _ := cookiejar.New(nil)
+	vars := make(map[string]string)
+
+	for i, step := range website.Steps {
+		name := step.name(i)
+		start := time.Now()
+		stepMeta := MetaResponse{}
+		var resp *http.Response
+		var body []byte
+		var client *http.Client
+		sw, err := step.website(website, vars)
+		if err == nil {
+			stepMeta.URL = sw.URL
+			client, err = newClient(sw, timeout, &stepMeta, jar)
+		}
+		if err == nil {
+			resp, body, err = check(ctx, client, sw, &stepMeta)
+		}
+		if err != nil {
+			stepMeta.Available = false
+			stepMeta.Failure = FailureRequest
+			stepMeta.Error = err.Error()
+		}
+		for _, e := range step.Extract {
+			if !stepMeta.Available {
+				break
+			}
+			v, err := e.extract(resp, body)
+			if err != nil {
+				stepMeta.Available = false
+				stepMeta.Failure = FailureAssertion
+				stepMeta.Error = fmt.Sprintf("cannot extract %s : %v", e.Var, err)
+			}
+			vars[e.Var] = v
+		}
+
+		//Aggregate step into the transaction
+		meta.Steps = append(meta.Steps, StepResult{name, stepMeta.Code, time.Now().Sub(start), stepMeta.RespDuration, stepMeta.Available, stepMeta.Error})
+		meta.Code = stepMeta.Code
+		meta.DNSDuration += stepMeta.DNSDuration
+		meta.ConnectDuration += stepMeta.ConnectDuration
+		meta.TLSDuration += stepMeta.TLSDuration
+		meta.RespDuration += stepMeta.RespDuration
+		meta.TransferDuration += stepMeta.TransferDuration
+		if meta.TLS == nil {
+			meta.TLS = stepMeta.TLS
+		}
+		if !stepMeta.Available {
+			meta.Available = false
+			meta.Failure = stepMeta.Failure
+			meta.Error = name + " : " + stepMeta.Error
+			meta.FailedAssertions = stepMeta.FailedAssertions
+			meta.FailedStep = name
+			break
+		}
+	}
+	meta.Timestamp = time.Now()
+	return meta, nil
+}
@@ -0,0 +1,406 @@
+package micromon
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//ConfigError is an error of the configuration file. Path locates the faulty entry, e.g. "websites.github.interval",
+//and Line is its line in the file, or 0 if it is unknown.
+type ConfigError struct {
+	Line int
+	Path string
+	Msg  string
+}
+
+func (e ConfigError) Error() string {
+	msg := e.Msg
+	if e.Path != "" {
+		msg = e.Path + " : " + msg
+	}
+	if e.Line > 0 {
+		msg = fmt.Sprintf("line %d : %s", e.Line, msg)
+	}
+	return msg
+}
+
+//ConfigErrors holds all the errors found in a configuration file, ordered by line.
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+//decodeErrorRegex matches errors of strict YAML decoding, which are prefixed by their line.
+var decodeErrorRegex = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+//validator collects errors of a configuration file, locating them in the YAML source.
+type validator struct {
+	data []byte
+	errs ConfigErrors
+}
+
+//add records an error about the entry which path is given in parameter.
+//Sequence entries are designated by their index, e.g. ("timeframes", "0", "span").
+func (v *validator) add(err error, path ...string) {
+	v.errs = append(v.errs, ConfigError{yamlLine(v.data, path), strings.Join(path, "."), err.Error()})
+}
+
+//addf records an error built from a format about the entry which path is given in parameter.
+func (v *validator) addf(path []string, format string, a ...interface{}) {
+	v.add(fmt.Errorf(format, a...), path...)
+}
+
+//addDecodeError records an error of strict YAML decoding, e.g. an unknown field or a value of the wrong type.
+func (v *validator) addDecodeError(msg string) {
+	if m := decodeErrorRegex.FindStringSubmatch(msg); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		v.errs = append(v.errs, ConfigError{Line: line, Msg: m[2]})
+		return
+	}
+	v.errs = append(v.errs, ConfigError{Msg: msg})
+}
+
+//err returns the collected errors ordered by line, or nil if there is none.
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(v.errs, func(i, j int) bool {
+		if v.errs[i].Line != v.errs[j].Line {
+			return v.errs[i].Line < v.errs[j].Line
+		}
+		return v.errs[i].Path < v.errs[j].Path
+	})
+	return v.errs
+}
+
+//secrets resolves the secrets referenced by websites of a valid configuration, and checks that the secrets of notifiers
+//can be resolved. Push tokens are checked once resolved, as they must be valid and unique.
+func (v *validator) secrets(conf Config) Config {
+	var err error
+	tokens := make(map[string]bool)
+	for k, w := range conf.Websites {
+		if w.Request, err = resolveSecrets(w.Request); err != nil {
+			v.add(err, "websites", k)
+		}
+		if w.Type == "push" {
+			if w.Token, err = resolveSecret(w.Token); err != nil || w.Token == "" || strings.Contains(w.Token, "/") {
+				v.addf([]string{"websites", k, "token"}, "push websites need a valid token")
+			} else if tokens[w.Token] {
+				v.addf([]string{"websites", k, "token"}, "token is already used")
+			}
+			tokens[w.Token] = true
+		}
+		steps := make([]Step, len(w.Steps))
+		for i, step := range w.Steps {
+			if step.Request, err = resolveSecrets(step.Request); err != nil {
+				v.add(err, "websites", k, "steps", strconv.Itoa(i))
+			}
+			steps[i] = step
+		}
+		w.Steps = steps
+		conf.Websites[k] = w
+	}
+	for name, n := range conf.Notifiers {
+		if _, err := n.resolveSecrets(); err != nil {
+			v.add(err, "notifiers", name)
+		}
+	}
+	return conf
+}
+
+//config validates the global settings of a configuration, websites being validated while validateConfig prepares them.
+func (v *validator) config(conf Config) {
+	if conf.DefaultInterval < 0 {
+		v.addf([]string{"defaultinterval"}, "must not be negative")
+	}
+	if conf.Timeout <= 0 {
+		v.addf([]string{"timeout"}, "must be positive")
+	}
+	if conf.AvailThreshold < 0 || conf.AvailThreshold > 100 {
+		v.addf([]string{"availthreshold"}, "must be a percentage between 0 and 100")
+	}
+	v.hysteresis(conf.Hysteresis, Hysteresis{}, conf.AvailThreshold, "hysteresis")
+	for i, t := range conf.CertThresholds {
+		if t <= 0 {
+			v.addf([]string{"certthresholds", strconv.Itoa(i)}, "must be a positive number of days")
+		}
+	}
+	for i, m := range conf.Metrics {
+		if _, err := GetMetric(string(m)); err != nil {
+			v.add(err, "metrics", strconv.Itoa(i))
+		}
+	}
+	v.hooks(conf, conf.Hooks, "hooks")
+	if _, err := getFormatter(conf.Format); err != nil {
+		v.add(err, "format")
+	}
+	//Alerting hooks keep their own state in each timeframe, while incidents and notifiers are shared
+	alerting := make(map[string]string)
+	for i, tf := range conf.Timeframes {
+		path := []string{"timeframes", strconv.Itoa(i)}
+		for _, h := range tf.Hooks {
+			if h != "alert" && h != "cert" {
+				continue
+			}
+			if other, ok := alerting[h]; ok {
+				v.addf(append(path, "hooks"), "%s hook is already used by timeframes.%s", h, other)
+			}
+			alerting[h] = strconv.Itoa(i)
+		}
+		if tf.Span <= 0 {
+			v.addf(append(path, "span"), "must be positive")
+		}
+		if tf.Every <= 0 {
+			v.addf(append(path, "every"), "must be positive")
+		}
+		v.hooks(conf, tf.Hooks, append(path, "hooks")...)
+		if _, err := getFormatter(tf.Format); err != nil {
+			v.add(err, append(path, "format")...)
+		}
+	}
+	if conf.PushListen != "" {
+		if _, _, err := net.SplitHostPort(conf.PushListen); err != nil {
+			v.add(err, "pushlisten")
+		}
+	}
+	if conf.Retention.MaxAge < 0 {
+		v.addf([]string{"retention", "maxage"}, "must not be negative")
+	}
+	if conf.Retention.MaxSamples < 0 {
+		v.addf([]string{"retention", "maxsamples"}, "must not be negative")
+	}
+	if err := conf.Storage.validate(); err != nil {
+		v.add(err, "storage")
+	}
+	names := make(map[string]bool)
+	for i, w := range conf.Maintenance {
+		path := []string{"maintenance", strconv.Itoa(i)}
+		if _, err := w.compile(); err != nil {
+			v.add(err, path...)
+		}
+		if w.Name != "" && names[w.Name] {
+			v.addf(append(path, "name"), "another maintenance window is named %s", w.Name)
+		}
+		names[w.Name] = true
+	}
+	if conf.Incidents.MaxAge < 0 {
+		v.addf([]string{"incidents", "maxage"}, "must not be negative")
+	}
+	if conf.Incidents.MaxCount < 0 {
+		v.addf([]string{"incidents", "maxcount"}, "must not be negative")
+	}
+	for name, n := range conf.Notifiers {
+		if err := n.validate(); err != nil {
+			v.add(err, "notifiers", name)
+		}
+		if n.Retries != nil && *n.Retries < 0 {
+			v.addf([]string{"notifiers", name, "retries"}, "must not be negative")
+		}
+		if n.Backoff < 0 || n.Timeout < 0 {
+			v.addf([]string{"notifiers", name}, "durations must not be negative")
+		}
+	}
+}
+
+//rules validates alert rules : expressions, names, which must be unique, and targeted websites or groups.
+func (v *validator) rules(conf Config) {
+	names := make(map[string]bool)
+	for i, r := range conf.Rules {
+		path := []string{"rules", strconv.Itoa(i)}
+		a, err := r.compile()
+		if err != nil {
+			field := "metric"
+			if r.Expr != "" {
+				field = "expr"
+			}
+			v.add(err, append(path, field)...)
+			continue
+		}
+		if names[a.Name] {
+			v.addf(append(path, "name"), "another rule is named %s", a.Name)
+		}
+		//Rules would be evaluated on truncated data
+		if _, rolled := a.metric.(RollupMetric); conf.Retention.MaxAge > 0 && a.Window > conf.Retention.MaxAge && !(rolled && conf.Retention.Rollups) {
+			v.addf(append(path, "window"), "is longer than retention.maxage")
+		}
+		names[a.Name] = true
+		for j, name := range r.Notify {
+			if _, ok := conf.Notifiers[name]; !ok {
+				v.addf(append(path, "notify", strconv.Itoa(j)), "no notifier is named %s", name)
+			}
+		}
+		for j, w := range r.Websites {
+			_, isWebsite := conf.Websites[w]
+			_, isGroup := conf.Groups[w]
+			if !isWebsite && !isGroup {
+				v.addf(append(path, "websites", strconv.Itoa(j)), "no website or group is named %s", w)
+			}
+		}
+	}
+}
+
+//overrides validates the settings of a website which override global ones.
+func (v *validator) overrides(conf Config, w Website, path ...string) {
+	if w.Timeout < 0 {
+		v.addf(append(path, "timeout"), "must not be negative")
+	}
+	if w.AvailThreshold < 0 || w.AvailThreshold > 100 {
+		v.addf(append(path, "availthreshold"), "must be a percentage between 0 and 100")
+	}
+	threshold := w.AvailThreshold
+	if threshold == 0 {
+		threshold = conf.AvailThreshold
+	}
+	v.hysteresis(w.Hysteresis, conf.Hysteresis, threshold, append(path, "hysteresis")...)
+	for i, t := range w.CertThresholds {
+		if t <= 0 {
+			v.addf(append(path, "certthresholds", strconv.Itoa(i)), "must be a positive number of days")
+		}
+	}
+	for i, m := range w.Metrics {
+		if _, err := GetMetric(string(m)); err != nil {
+			v.add(err, append(path, "metrics", strconv.Itoa(i))...)
+		}
+	}
+	v.hooks(conf, w.Hooks, append(path, "hooks")...)
+}
+
+//hysteresis validates hysteresis settings : the recovery threshold must not be below the availability threshold,
+//and a website cannot change state more often than evaluated. Settings of websites are validated along with the global
+//ones they inherit.
+func (v *validator) hysteresis(h Hysteresis, global Hysteresis, threshold float64, path ...string) {
+	if h.RecoveryThreshold != 0 && (h.RecoveryThreshold < threshold || h.RecoveryThreshold > 100) {
+		v.addf(append(path, "recoverythreshold"), "must be a percentage between the availability threshold and 100")
+	}
+	if h.Consecutive < 0 {
+		v.addf(append(path, "consecutive"), "must not be negative")
+	}
+	if h.FlapWindow < 0 {
+		v.addf(append(path, "flapwindow"), "must not be negative")
+	}
+	window := h.FlapWindow
+	if window == 0 {
+		window = global.FlapWindow
+	}
+	if window == 0 {
+		window = defaultFlapWindow
+	}
+	if h.FlapChanges < 0 || h.FlapChanges > window {
+		v.addf(append(path, "flapchanges"), "must be between 0 and the flap window")
+	}
+}
+
+//hooks validates hook names. Notifiers are validated on their own, hooks are built without them nor incident history.
+func (v *validator) hooks(conf Config, hooks []string, path ...string) {
+	for i, h := range hooks {
+		if _, err := getHook(h, conf, &alerting{&notifiers{}, &IncidentHistory{}, nil, &Silences{}}); err != nil {
+			v.add(err, append(path, strconv.Itoa(i))...)
+		}
+	}
+}
+
+//websiteURL validates the URL of a website according to its type.
+func websiteURL(website Website) error {
+	switch website.Type {
+	case "", "http":
+		u, err := url.Parse(website.URL)
+		if err != nil {
+			return err
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s is not an absolute HTTP(S) URL", website.URL)
+		}
+	case "tcp", "tls":
+		_, err := probeAddress(website.URL, website.Type)
+		return err
+	case "dns":
+		if strings.TrimPrefix(website.URL, "dns://") == "" {
+			return fmt.Errorf("a host name is needed")
+		}
+	}
+	return nil
+}
+
+//yamlEntry is a line of a YAML document, reduced to its indentation and content.
+//Sequence items are split into an item entry and an entry for their content, indented as a mapping would be.
+type yamlEntry struct {
+	line   int
+	indent int
+	item   bool
+	text   string
+}
+
+//yamlEntries splits a YAML document in entries, ignoring blank lines and comments.
+func yamlEntries(data []byte) []yamlEntry {
+	entries := make([]yamlEntry, 0)
+	for i, l := range strings.Split(string(data), "\n") {
+		text := strings.TrimLeft(l, " ")
+		indent := len(l) - len(text)
+		text = strings.TrimSpace(text)
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		for text == "-" || strings.HasPrefix(text, "- ") {
+			entries = append(entries, yamlEntry{i + 1, indent, true, "-"})
+			rest := strings.TrimLeft(text[1:], " ")
+			indent += len(text) - len(rest)
+			text = rest
+		}
+		if text != "" {
+			entries = append(entries, yamlEntry{i + 1, indent, false, text})
+		}
+	}
+	return entries
+}
+
+//yamlLine returns the line of the entry which path is given in parameter, in a YAML document written in block style.
+//If the entry cannot be found, the line of its deepest found ancestor is returned, or 0.
+func yamlLine(data []byte, path []string) int {
+	entries := yamlEntries(data)
+	lo, hi, line := 0, len(entries), 0
+	for _, seg := range path {
+		index, err := strconv.Atoi(seg)
+		isIndex := err == nil
+		found, n := -1, 0
+		for i := lo; i < hi && found == -1; i++ {
+			e := entries[i]
+			if e.indent != entries[lo].indent {
+				continue
+			}
+			if isIndex && e.item {
+				if n == index {
+					found = i
+				}
+				n++
+			} else if !isIndex && !e.item && strings.HasPrefix(strings.ToLower(e.text), strings.ToLower(seg)+":") {
+				found = i
+			}
+		}
+		if found == -1 {
+			return line
+		}
+
+		//Children are more indented, except sequence items which may be at the same level as their key
+		parent := entries[found]
+		line = parent.line
+		lo, hi = found+1, found+1
+		for hi < len(entries) && (entries[hi].indent > parent.indent || (!parent.item && entries[hi].indent == parent.indent && entries[hi].item)) {
+			hi++
+		}
+		if lo == hi {
+			return line
+		}
+	}
+	return line
+}
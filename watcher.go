@@ -1,96 +1,370 @@
 package micromon
 
 import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptrace"
+	"strings"
+	"sync"
 	"time"
 )
 
 //MetaResponse holds a website response's metadata, e.g. response code, response time, availibity, language...
+//RespDuration is the server processing time, i.e. from the request being written to the first response byte.
+//When the website is unavailable, Failure classifies the reason and Error holds the error message.
+//FailedAssertions describes the website assertions the response did not satisfy, which makes it unavailable.
+//TLS describes the TLS connection and the peer certificates, for HTTPS websites.
+//Labels are the labels of the website.
+//For multi-step transactions, Steps holds the outcome of each performed step and FailedStep the name of the failing one.
+//Maintenance is the name of the maintenance window the website was checked during, if any, and ExcludedFromAvailability
+//tells whether the window excludes the check from availability.
+//Other durations break down the remaining phases of the request ; they are zero if the phase did not happen
+//(e.g. no TLS handshake for plain HTTP) or failed and TransferDuration is only measured when the body is read.
 type MetaResponse struct {
-	URL              string
-	Name             string
-	Code             int
-	wroteRequestTime time.Time
-	RespDuration     time.Duration
-	Timestamp        time.Time
-	Available        bool
-}
-
-//WatchWebsites takes the app configuration and checks the URLs at user-defined intervals.
-//It returns a channel which will receive MetaResponse each time a request is completed.
-//Each website has its own timed goroutine.
-func WatchWebsites(conf Config) chan MetaResponse {
-	ch := make(chan MetaResponse, 100)
+	URL                      string
+	Name                     string
+	Labels                   map[string]string
+	Code                     int
+	dnsStartTime             time.Time
+	connectStartTime         time.Time
+	tlsStartTime             time.Time
+	tlsError                 error
+	wroteRequestTime         time.Time
+	firstByteTime            time.Time
+	DNSDuration              time.Duration
+	ConnectDuration          time.Duration
+	TLSDuration              time.Duration
+	RespDuration             time.Duration
+	TransferDuration         time.Duration
+	Timestamp                time.Time
+	Available                bool
+	Failure                  FailureReason
+	Error                    string
+	FailedAssertions         []string
+	TLS                      *TLSInfo
+	Steps                    []StepResult
+	FailedStep               string
+	Maintenance              string
+	ExcludedFromAvailability bool
+}
+
+//WatchWebsites takes the app configuration and checks the websites at user-defined intervals, with the Prober of their type.
+//It returns a channel which will receive MetaResponse each time a check is completed.
+//Each website has its own timed goroutine. Push websites are not checked : they ping MicroMon, see watchHeartbeats.
+//When the context is cancelled, in-flight checks are aborted and the channel is closed once all goroutines have returned.
+//A non-nil error is returned if the push endpoint cannot be served.
+func WatchWebsites(ctx context.Context, conf Config) (<-chan MetaResponse, error) {
+	w := newWatchers(ctx, conf)
+	if err := w.startHeartbeats(conf); err != nil {
+		return nil, err
+	}
 	for name, website := range conf.Websites {
-		//Each website has an associated goroutine which perform a request
-		//every X seconds, X user-defined, and send it to the global channel
-		go func(name string, website Website, dataChan chan MetaResponse, timeout time.Duration) {
-			for range time.Tick(time.Duration(website.Interval) * time.Second) {
-				feedChan(website.URL, name, dataChan, timeout)
+		w.start(name, website)
+	}
+	go w.close()
+	return w.ch, nil
+}
+
+//watchers holds the goroutines which check websites and send MetaResponse to a shared channel.
+//Unlike WatchWebsites, it allows to start and stop websites individually, and to restart the push endpoint.
+//It is not safe for concurrent use.
+type watchers struct {
+	ctx        context.Context
+	ch         chan MetaResponse
+	timeout    time.Duration
+	wg         sync.WaitGroup
+	cancels    map[string]context.CancelFunc
+	heartbeats context.CancelFunc
+	hbWg       *sync.WaitGroup
+}
+
+//newWatchers returns watchers bound to a context, with the timeout of the configuration.
+func newWatchers(ctx context.Context, conf Config) *watchers {
+	return &watchers{
+		ctx:     ctx,
+		ch:      make(chan MetaResponse, 100),
+		timeout: time.Duration(conf.Timeout),
+		cancels: make(map[string]context.CancelFunc),
+	}
+}
+
+//start starts the goroutine which checks a website every X seconds, X user-defined, and sends results to the channel.
+//Push websites are ignored, see startHeartbeats.
+func (w *watchers) start(name string, website Website) {
+	if website.Type == "push" {
+		return
+	}
+	ctx, cancel := context.WithCancel(w.ctx)
+	w.cancels[name] = cancel
+	w.wg.Add(1)
+	//The website may override the global timeout
+	timeout := w.timeout
+	if website.Timeout > 0 {
+		timeout = time.Duration(website.Timeout)
+	}
+	//Invalid regular expressions are reported by each check instead
+	if compiled, err := website.compile(); err == nil {
+		website = compiled
+	}
+	go func() {
+		defer w.wg.Done()
+		ticker := time.NewTicker(time.Duration(website.Interval))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				feedChan(ctx, website, name, w.ch, timeout)
 			}
-		}(name, website, ch, time.Duration(conf.Timeout)*time.Second)
+		}
+	}()
+}
+
+//compile returns the Website with the regular expressions of its assertions and steps compiled, see Assertions.compile.
+//Steps are copied, so that the configuration is left untouched.
+func (website Website) compile() (Website, error) {
+	var err error
+	if website.Assertions, err = website.Assertions.compile(); err != nil {
+		return website, err
 	}
-	return ch
+	website.Steps = append([]Step{}, website.Steps...)
+	for i, s := range website.Steps {
+		if website.Steps[i], err = s.compile(); err != nil {
+			return website, err
+		}
+	}
+	return website, nil
+}
+
+//stop stops checking a website. An in-flight check is aborted.
+func (w *watchers) stop(name string) {
+	if cancel, ok := w.cancels[name]; ok {
+		cancel()
+		delete(w.cancels, name)
+	}
+}
+
+//startHeartbeats serves the push endpoint for push websites of the configuration, stopping the previous one if any.
+func (w *watchers) startHeartbeats(conf Config) error {
+	w.stopHeartbeats()
+	ctx, cancel := context.WithCancel(w.ctx)
+	hbWg := &sync.WaitGroup{}
+	if err := watchHeartbeats(ctx, conf, w.ch, hbWg); err != nil {
+		cancel()
+		return err
+	}
+	w.heartbeats, w.hbWg = cancel, hbWg
+	//The channel must not be closed before the push endpoint is shut down
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		hbWg.Wait()
+	}()
+	return nil
+}
+
+//stopHeartbeats shuts the push endpoint down and waits for it, so that its address can be listened to again.
+func (w *watchers) stopHeartbeats() {
+	if w.heartbeats != nil {
+		w.heartbeats()
+		w.hbWg.Wait()
+		w.heartbeats, w.hbWg = nil, nil
+	}
+}
+
+//close waits for all goroutines to return, once the context is cancelled, and closes the channel.
+func (w *watchers) close() {
+	w.wg.Wait()
+	close(w.ch)
 }
 
-//feedChan takes an url, check it with a custom timeout, compute a MetaResponse and
+//feedChan takes a website, check it with a custom timeout, compute a MetaResponse and
 //put it in a channel to make it compatible with the use of goroutines.
-func feedChan(url string, name string, data chan MetaResponse, timeout time.Duration) {
-	metaResp, err := CheckUrl(url, timeout)
+//Checks interrupted by the cancellation of the context are not sent, as they say nothing about the website.
+func feedChan(ctx context.Context, website Website, name string, data chan MetaResponse, timeout time.Duration) {
+	prober, err := GetProber(website.Type)
+	if err != nil {
+		log.Printf("Warning : cannot check %s : %v", name, err)
+		return
+	}
+	metaResp, err := prober.Probe(ctx, website, timeout)
 	if err != nil {
-		log.Fatalf("%v", err)
+		log.Printf("Warning : cannot check %s : %v", name, err)
+		return
+	}
+	if ctx.Err() != nil {
+		return
 	}
-	//Add name to make MetaResponse independent
+	//Add name and labels to make MetaResponse independent
 	metaResp.Name = name
-	data <- metaResp
+	metaResp.Labels = website.Labels
+	select {
+	case data <- metaResp:
+	case <-ctx.Done():
+	}
 }
 
-//CheckUrl produces a MetaResponse after visiting a given Website.
+//CheckUrl produces a MetaResponse after visiting a given URL, without reading the response body.
 //So called "response time" is measured as the interval bewteen the start of server processing and the first byte received.
 func CheckUrl(url string, timeout time.Duration) (MetaResponse, error) {
-	meta := MetaResponse{URL: url}
+	return CheckWebsite(context.Background(), Website{URL: url}, timeout)
+}
 
-	//New Client with low timeout
-	client := http.Client{Timeout: timeout}
+//CheckWebsite produces a MetaResponse after visiting a given Website, or after performing its steps if it has any.
+//Each check uses a new connection, so that DNS, connection and TLS phases are always measured.
+//The response body is downloaded only if the Website asks for it, to measure the transfer phase, or if assertions need it.
+//Assertions are evaluated on the response : if any of them fails, the website is considered unavailable.
+//The request is aborted if the context is cancelled.
+func CheckWebsite(ctx context.Context, website Website, timeout time.Duration) (MetaResponse, error) {
+	if len(website.Steps) > 0 {
+		return checkTransaction(ctx, website, timeout)
+	}
+	meta := MetaResponse{URL: website.URL}
+	client, err := newClient(website, timeout, &meta, nil)
+	if err != nil {
+		return meta, err
+	}
+	_, _, err = check(ctx, client, website, &meta)
+	return meta, err
+}
 
-	//GET request with trace behaviour
-	req, _ := http.NewRequest("GET", url, nil)
-	req = withMetaResponse(req, &meta)
+//newClient returns an HTTP client with a timeout, no connection reuse and TLS state recording in a MetaResponse.
+//A cookie jar may be given to share cookies between requests.
+func newClient(website Website, timeout time.Duration, meta *MetaResponse, jar http.CookieJar) (*http.Client, error) {
+	tlsConf, err := tlsClientConfig(website.TLS, meta)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment, DisableKeepAlives: true, TLSClientConfig: tlsConf}
+	return &http.Client{Timeout: timeout, Transport: transport, Jar: jar}, nil
+}
 
-	//Perform GET request, feed MetaResponse and return values
+//check performs the request of a Website with a client and feeds a MetaResponse.
+//It returns the response, if any, and its body if it has been read.
+func check(ctx context.Context, client *http.Client, website Website, meta *MetaResponse) (*http.Response, []byte, error) {
+	//Request with trace behaviour
+	req, err := newRequest(ctx, website.URL, website.Request)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, done := withMetaResponse(req, meta)
+
+	//Perform request, feed MetaResponse and return values
 	resp, err := client.Do(req)
+	done()
 
 	meta.Timestamp = time.Now()
 
 	//We consider all errors as unavailability (if we only handle net.error Timeout error type, a non-existing URL throws an error)
 	if err != nil {
+		if meta.tlsError != nil {
+			err = handshakeError{meta.tlsError}
+		}
+		*meta = failedProbe(*meta, err)
+		return nil, nil, nil
+	}
+	defer resp.Body.Close()
+	meta.Available = true
+	meta.Code = resp.StatusCode
+	var body []byte
+	if website.ReadBody || website.Assertions.needsBody() {
+		//A body which cannot be entirely read is an unavailability as well
+		body, err = readBody(resp.Body, website.Assertions.MaxBodySize)
+		meta.TransferDuration = time.Now().Sub(meta.firstByteTime)
+		if err != nil {
+			meta.Available = false
+			meta.Failure = FailureTransfer
+			meta.Error = err.Error()
+			return resp, nil, nil
+		}
+	}
+	meta.FailedAssertions = website.Assertions.check(resp, body, *meta)
+	if len(meta.FailedAssertions) > 0 {
 		meta.Available = false
-	} else {
-		meta.Available = true
-		meta.Code = resp.StatusCode
+		meta.Failure = FailureAssertion
+		meta.Error = strings.Join(meta.FailedAssertions, ", ")
 	}
+	return resp, body, nil
+}
 
-	return meta, nil
+//readBody reads a response body. If a maximum size is given, at most one byte more is read so that exceeding the size can be detected.
+func readBody(body io.Reader, max int64) ([]byte, error) {
+	if max > 0 {
+		body = io.LimitReader(body, max+1)
+	}
+	return ioutil.ReadAll(body)
 }
 
 //withMetaResponse adapts an HTTP Request to feed a MetaResponse object while performing request, thank to httptrace features.
-//Returns a pointer to the augmented Request.
-func withMetaResponse(req *http.Request, meta *MetaResponse) *http.Request {
+//Returns a pointer to the augmented Request, and a function to call once the request is done : dials may still be
+//running after a failed request, and must not feed the MetaResponse anymore.
+func withMetaResponse(req *http.Request, meta *MetaResponse) (*http.Request, func()) {
+	//Dials may run concurrently, and outlive the request
+	var mux sync.Mutex
+	connected, done := false, false
+	record := func(f func()) {
+		mux.Lock()
+		defer mux.Unlock()
+		if !done {
+			f()
+		}
+	}
 	newReq := req.WithContext(
 		httptrace.WithClientTrace(
 			req.Context(),
 			&httptrace.ClientTrace{
+				DNSStart: func(info httptrace.DNSStartInfo) {
+					record(func() { meta.dnsStartTime = time.Now() })
+				},
+				DNSDone: func(info httptrace.DNSDoneInfo) {
+					record(func() { meta.DNSDuration = time.Now().Sub(meta.dnsStartTime) })
+				},
+				//Multiple addresses may be tried, in parallel : measure from the first attempt to the first connection
+				ConnectStart: func(network, addr string) {
+					record(func() {
+						if meta.connectStartTime.IsZero() {
+							meta.connectStartTime = time.Now()
+						}
+					})
+				},
+				ConnectDone: func(network, addr string, err error) {
+					record(func() {
+						if err == nil && !connected {
+							connected = true
+							meta.ConnectDuration = time.Now().Sub(meta.connectStartTime)
+						}
+					})
+				},
+				TLSHandshakeStart: func() {
+					record(func() { meta.tlsStartTime = time.Now() })
+				},
+				//A failed handshake is recorded as the cause of the failure, rather than as a TLS phase
+				TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+					record(func() {
+						if err != nil {
+							meta.tlsError = err
+						} else {
+							meta.TLSDuration = time.Now().Sub(meta.tlsStartTime)
+						}
+					})
+				},
 				//After DNS lookup and eventual TLS handshake : server starts processing
 				WroteRequest: func(info httptrace.WroteRequestInfo) {
-					meta.wroteRequestTime = time.Now()
+					record(func() { meta.wroteRequestTime = time.Now() })
 				},
 				//Server has processed and first byte is received : able to calculate accurate response-time
 				GotFirstResponseByte: func() {
-					meta.RespDuration = time.Now().Sub(meta.wroteRequestTime)
+					record(func() {
+						meta.firstByteTime = time.Now()
+						meta.RespDuration = meta.firstByteTime.Sub(meta.wroteRequestTime)
+					})
 				},
 			}),
 	)
-	return newReq
+	return newReq, func() { record(func() { done = true }) }
 }